@@ -58,7 +58,7 @@ func main() {
 
 	appState := app.NewState()
 
-	jobFactory := app.NewJobFactory()
+	jobFactory := app.NewJobFactory(configStore.Dir())
 
 	jobs, err := jobFactory.CreateFromConfig(cfg)
 	if err != nil {
@@ -71,6 +71,7 @@ func main() {
 	}
 
 	dispatcher := app.NewDispatcher(appState)
+	dispatcher.UpdateWatches()
 
 	if cfg.CheckInterval > 0 {
 		log.Printf("Starting scheduler with interval: %d minutes", int(cfg.CheckInterval.Minutes()))
@@ -90,6 +91,7 @@ func main() {
 		appState,
 		statusWindow,
 		jobFactory,
+		dispatcher,
 	)
 
 	go handleTrayEvents(systemTray, dispatcher, settingsWindow, statusWindow)
@@ -2,6 +2,7 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
@@ -12,10 +13,11 @@ import (
 
 // JobEvent represents an event from job execution.
 type JobEvent struct {
-	JobName string
-	Status  syncpkg.JobStatus
-	Result  *syncpkg.SyncResult
-	Error   error
+	JobName   string
+	Status    syncpkg.JobStatus
+	Result    *syncpkg.SyncResult
+	Conflicts int
+	Error     error
 }
 
 type Dispatcher struct {
@@ -26,16 +28,21 @@ type Dispatcher struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
+
+	// watches cancels the source watch of each continuous job.
+	watchMu sync.Mutex
+	watches map[*syncpkg.Job]context.CancelFunc
 }
 
 func NewDispatcher(state *State) *Dispatcher {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &Dispatcher{
-		state:  state,
-		events: make(chan JobEvent, 100),
-		ctx:    ctx,
-		cancel: cancel,
+		state:   state,
+		events:  make(chan JobEvent, 100),
+		ctx:     ctx,
+		cancel:  cancel,
+		watches: make(map[*syncpkg.Job]context.CancelFunc),
 	}
 }
 
@@ -55,12 +62,24 @@ func (d *Dispatcher) RunNow(jobName string) error {
 	d.wg.Add(1)
 	go func() {
 		defer d.wg.Done()
-		d.runJob(job)
+		d.runJob(job, job.Run)
 	}()
 
 	return nil
 }
 
+// ApplyPlan carries out a previewed plan for job in the background,
+// reporting the outcome like any other run.
+func (d *Dispatcher) ApplyPlan(job *syncpkg.Job, plan *syncpkg.Plan) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.runJob(job, func(ctx context.Context) (*syncpkg.SyncResult, error) {
+			return job.Apply(ctx, plan)
+		})
+	}()
+}
+
 func (d *Dispatcher) RunAll() {
 	jobs := d.state.AllJobs()
 
@@ -69,7 +88,7 @@ func (d *Dispatcher) RunAll() {
 		d.wg.Add(1)
 		go func() {
 			defer d.wg.Done()
-			d.runJob(job)
+			d.runJob(job, job.Run)
 		}()
 	}
 }
@@ -102,7 +121,9 @@ func (d *Dispatcher) Stop() {
 	log.Println("Dispatcher stopped")
 }
 
-func (d *Dispatcher) runJob(job *syncpkg.Job) {
+// runJob runs job and reports the outcome. It returns the run's error,
+// which is ErrJobRunning when the job was busy and nothing was done.
+func (d *Dispatcher) runJob(job *syncpkg.Job, run func(context.Context) (*syncpkg.SyncResult, error)) error {
 	log.Printf("Running job: %s", job.Name)
 
 	// Create job-specific context with timeout
@@ -110,7 +131,11 @@ func (d *Dispatcher) runJob(job *syncpkg.Job) {
 	defer cancel()
 
 	// Run the job
-	result, err := job.Run(ctx)
+	result, err := run(ctx)
+	if errors.Is(err, syncpkg.ErrJobRunning) {
+		log.Printf("Job %s is still running, skipped", job.Name)
+		return err
+	}
 
 	// Emit event
 	event := JobEvent{
@@ -119,6 +144,9 @@ func (d *Dispatcher) runJob(job *syncpkg.Job) {
 		Result:  result,
 		Error:   err,
 	}
+	if result != nil {
+		event.Conflicts = result.Conflicts
+	}
 
 	select {
 		case d.events <- event:
@@ -128,7 +156,17 @@ func (d *Dispatcher) runJob(job *syncpkg.Job) {
 	if err != nil {
 		log.Printf("Job %s failed: %v", job.Name, err)
 	} else {
-		log.Printf("Job %s completed: %d created, %d updated, %d deleted",
-			job.Name, result.FilesCreated, result.FilesUpdated, result.FilesDeleted)
+		log.Printf("Job %s completed: %d created, %d updated, %d deleted, %d conflicts",
+			job.Name, result.FilesCreated, result.FilesUpdated, result.FilesDeleted, result.Conflicts)
+		if methods := result.CopyMethodSummary(); methods != "" {
+			log.Printf("Job %s copied by %s", job.Name, methods)
+		}
 	}
+	if result != nil {
+		for _, warning := range result.Warnings {
+			log.Printf("Job %s: %s", job.Name, warning)
+		}
+	}
+
+	return err
 }
@@ -2,16 +2,32 @@ package app
 
 import (
 	"fmt"
+	"path/filepath"
+	"time"
 
 	"excellgene.com/mirrorBox/internal/config"
 	syncpkg "excellgene.com/mirrorBox/internal/sync"
+	"excellgene.com/mirrorBox/internal/sync/fs"
 )
 
+// MaxConcurrency caps the parallel transfers a single job may use.
+const MaxConcurrency = 64
+
 type JobFactory struct {
+	stateDir string
+
+	// limiter enforces the global bandwidth limit. It outlives reloads, so
+	// jobs still running from an older config share it with the new ones.
+	limiter *fs.RateLimiter
 }
 
-func NewJobFactory() *JobFactory {
-	return &JobFactory{}
+// NewJobFactory creates a factory whose jobs keep their persistent
+// state in per-job directories under stateDir.
+func NewJobFactory(stateDir string) *JobFactory {
+	return &JobFactory{
+		stateDir: stateDir,
+		limiter:  fs.NewRateLimiter(0),
+	}
 }
 
 // CreateFromConfig creates sync jobs from configuration.
@@ -19,13 +35,17 @@ func NewJobFactory() *JobFactory {
 func (f *JobFactory) CreateFromConfig(cfg *config.Config) ([]*syncpkg.Job, error) {
 	var jobs []*syncpkg.Job
 
+	if err := f.setRateLimit(cfg); err != nil {
+		return nil, err
+	}
+
 	for _, jobCfg := range cfg.Folders {
 		if !jobCfg.Enabled {
 			continue
 		}
 
-		name := "Sync " + jobCfg.SourcePath + " to " + jobCfg.DestinationPath
-		job, err := f.createJob(jobCfg)
+		name := JobName(jobCfg)
+		job, err := f.CreateJob(jobCfg)
 		if err != nil {
 			return nil, fmt.Errorf("create job %s: %w", name, err)
 		}
@@ -36,12 +56,138 @@ func (f *JobFactory) CreateFromConfig(cfg *config.Config) ([]*syncpkg.Job, error
 	return jobs, nil
 }
 
-// createJob creates a single sync job from config.
-func (f *JobFactory) createJob(cfg config.FolderToSync) (*syncpkg.Job, error) {
+// setRateLimit applies the global bandwidth limit and its schedule.
+func (f *JobFactory) setRateLimit(cfg *config.Config) error {
+	if cfg.RateLimit < 0 {
+		return fmt.Errorf("invalid rate limit: %d", cfg.RateLimit)
+	}
+
+	var windows []fs.RateWindow
+	for _, w := range cfg.RateSchedule {
+		start, err := fs.ParseTimeOfDay(w.Start)
+		if err != nil {
+			return fmt.Errorf("rate schedule: %w", err)
+		}
+		end, err := fs.ParseTimeOfDay(w.End)
+		if err != nil {
+			return fmt.Errorf("rate schedule: %w", err)
+		}
+		if w.Limit < 0 {
+			return fmt.Errorf("rate schedule: invalid limit: %d", w.Limit)
+		}
+		windows = append(windows, fs.RateWindow{Start: start, End: end, Limit: w.Limit})
+	}
+
+	f.limiter.SetRate(cfg.RateLimit, windows)
+	return nil
+}
+
+// JobName returns the name of the job created for a folder pair.
+func JobName(cfg config.FolderToSync) string {
+	return "Sync " + cfg.SourcePath + " to " + cfg.DestinationPath
+}
+
+// CreateJob creates a single sync job from config, whether or not the
+// folder is enabled.
+func (f *JobFactory) CreateJob(cfg config.FolderToSync) (*syncpkg.Job, error) {
+	compare, err := syncpkg.ParseCompareMode(cfg.CompareMode)
+	if err != nil {
+		return nil, err
+	}
+
+	conflicts, err := syncpkg.ParseConflictPolicy(cfg.ConflictPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	ignore, err := fs.ParseIgnoreRules(cfg.IgnoreRules)
+	if err != nil {
+		return nil, err
+	}
+
+	symlinks, err := fs.ParseSymlinkMode(cfg.SymlinkMode)
+	if err != nil {
+		return nil, err
+	}
+
+	normalization, err := fs.ParseNormalization(cfg.UnicodeNormalization)
+	if err != nil {
+		return nil, err
+	}
+
+	versioning, err := syncpkg.ParseVersioningMode(cfg.Versioning)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.VersionsKeep < 0 {
+		return nil, fmt.Errorf("invalid version retention: %d", cfg.VersionsKeep)
+	}
+
+	opts := syncpkg.Options{
+		DeleteExtraFiles: cfg.Mirror,
+		Compare:          compare,
+		TwoWay:           cfg.TwoWay,
+		Conflicts:        conflicts,
+		Ignore:           ignore,
+		Symlinks:         symlinks,
+		RewriteLinks:     cfg.RewriteSymlinks,
+		Delta:            cfg.DeltaTransfer,
+		Concurrency:      cfg.Concurrency,
+		Verify:           cfg.Verify,
+		Fsync:            cfg.Fsync,
+		Streaming:        cfg.Streaming,
+		IncrementalScan:  cfg.IncrementalScan,
+		FullRescan:       time.Duration(cfg.FullRescanHours) * time.Hour,
+		Continuous:       cfg.Continuous,
+		Normalization:    normalization,
+		CaseInsensitive:  cfg.CaseInsensitive,
+		SanitizeNames:    cfg.SanitizeNames,
+		Metadata: fs.MetadataOptions{
+			Xattrs:    cfg.PreserveXattrs,
+			ACLs:      cfg.PreserveACLs,
+			Ownership: cfg.PreserveOwnership,
+			DirTimes:  cfg.PreserveDirTimes,
+		},
+		Versioning: syncpkg.Versioning{Mode: versioning, Keep: cfg.VersionsKeep},
+		StateDir:   filepath.Join(f.stateDir, "jobs", cfg.StateKey()),
+	}
+
+	if cfg.DeleteLimit < 0 {
+		return nil, fmt.Errorf("invalid delete limit: %d", cfg.DeleteLimit)
+	}
+	if cfg.DeleteLimitPercent {
+		if cfg.DeleteLimit > 100 {
+			return nil, fmt.Errorf("invalid delete limit: %d%%", cfg.DeleteLimit)
+		}
+		opts.MaxDeletePercent = cfg.DeleteLimit
+	} else {
+		opts.MaxDeletes = cfg.DeleteLimit
+	}
+
+	// A folder with its own limit gets its own bucket instead of the
+	// shared global one.
+	switch {
+	case cfg.RateLimit < 0:
+		return nil, fmt.Errorf("invalid rate limit: %d", cfg.RateLimit)
+	case cfg.RateLimit > 0:
+		opts.RateLimiter = fs.NewRateLimiter(cfg.RateLimit)
+	default:
+		opts.RateLimiter = f.limiter
+	}
+
+	if cfg.Concurrency < 0 || cfg.Concurrency > MaxConcurrency {
+		return nil, fmt.Errorf("invalid concurrency: %d", cfg.Concurrency)
+	}
+
+	if cfg.FullRescanHours < 0 {
+		return nil, fmt.Errorf("invalid full rescan interval: %d hours", cfg.FullRescanHours)
+	}
+
 	job := syncpkg.NewJob(
-		"Sync " + cfg.SourcePath + " to " + cfg.DestinationPath,
+		JobName(cfg),
 		cfg.SourcePath,
 		cfg.DestinationPath,
+		opts,
 	)
 
 	return job, nil
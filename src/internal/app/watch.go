@@ -0,0 +1,151 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	syncpkg "excellgene.com/mirrorBox/internal/sync"
+	"excellgene.com/mirrorBox/internal/sync/fs"
+)
+
+const (
+	// watchDebounce is how long a continuous job waits for changes to
+	// settle, so a burst of them is synced in one run.
+	watchDebounce = 2 * time.Second
+
+	// watchMaxDelay caps the wait when changes never settle.
+	watchMaxDelay = 30 * time.Second
+
+	// watchMaxPaths is the number of changed paths above which a full run
+	// is cheaper than walking each of them.
+	watchMaxPaths = 1000
+
+	// watchRetry is how long a job whose source could not be watched waits
+	// before trying again. Scheduled runs go on in the meantime.
+	watchRetry = 5 * time.Minute
+)
+
+// UpdateWatches starts watching the sources of continuous jobs and stops
+// the watches of jobs no longer in the state. Call it whenever the jobs
+// are reloaded.
+func (d *Dispatcher) UpdateWatches() {
+	d.watchMu.Lock()
+	defer d.watchMu.Unlock()
+
+	current := make(map[*syncpkg.Job]bool)
+	for _, job := range d.state.AllJobs() {
+		if !job.Options.Continuous {
+			continue
+		}
+		current[job] = true
+		if _, ok := d.watches[job]; ok {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(d.ctx)
+		d.watches[job] = cancel
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.watchJob(ctx, job)
+		}()
+	}
+
+	for job, cancel := range d.watches {
+		if !current[job] {
+			cancel()
+			delete(d.watches, job)
+		}
+	}
+}
+
+// watchJob keeps a watch on job's source until ctx is cancelled. Whenever
+// the watch breaks down, changes may have been missed, so a full run is
+// made before watching again.
+func (d *Dispatcher) watchJob(ctx context.Context, job *syncpkg.Job) {
+	for {
+		err := d.watchChanges(ctx, job)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("Job %s: %v, running a full sync", job.Name, err)
+		d.runJob(job, job.Run)
+
+		if errors.Is(err, fs.ErrWatchOverflow) {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchRetry):
+		}
+	}
+}
+
+// watchChanges watches job's source and syncs the changed paths once they
+// settle. It returns when the watch fails or ctx is cancelled.
+func (d *Dispatcher) watchChanges(ctx context.Context, job *syncpkg.Job) error {
+	watcher, err := job.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	changes := make(chan string, 256)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- watcher.Watch(ctx, func(path string) {
+			select {
+			case changes <- path:
+			case <-ctx.Done():
+			}
+		})
+	}()
+
+	pending := make(map[string]bool)
+	var first time.Time
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case err := <-watchErr:
+			return err
+
+		case path := <-changes:
+			if len(pending) == 0 {
+				first = time.Now()
+			}
+			pending[path] = true
+			timer.Reset(min(watchDebounce, watchMaxDelay-time.Since(first)))
+
+		case <-timer.C:
+			run := job.Run
+			if len(pending) <= watchMaxPaths {
+				paths := make([]string, 0, len(pending))
+				for path := range pending {
+					paths = append(paths, path)
+				}
+				run = func(ctx context.Context) (*syncpkg.SyncResult, error) {
+					return job.RunSubtrees(ctx, paths)
+				}
+			}
+
+			// A busy job keeps its changes for the next try
+			if err := d.runJob(job, run); errors.Is(err, syncpkg.ErrJobRunning) {
+				timer.Reset(watchDebounce)
+				continue
+			}
+			pending = make(map[string]bool)
+		}
+	}
+}
@@ -1,11 +1,109 @@
 package config
 
-import "time"
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"time"
+)
 
 type FolderToSync struct {
 	SourcePath      string `json:"SourcePath"`
 	DestinationPath string `json:"DestinationPath"`
 	Enabled         bool   `json:"Enabled"`
+
+	// Mirror removes destination files that no longer exist at the source.
+	Mirror bool `json:"Mirror"`
+	// DeleteLimit caps how many entries a mirror run may delete (0 = no limit).
+	// When DeleteLimitPercent is set it is a percentage of the destination entries,
+	// rounded up.
+	DeleteLimit        int  `json:"DeleteLimit"`
+	DeleteLimitPercent bool `json:"DeleteLimitPercent"`
+
+	// CompareMode is "size-mtime" (default), "hash" or "always-hash".
+	CompareMode string `json:"CompareMode"`
+
+	// TwoWay applies changes made on either side to the other one.
+	TwoWay bool `json:"TwoWay"`
+
+	// ConflictPolicy is "source-wins" (default), "newest-wins", "keep-both" or "skip".
+	ConflictPolicy string `json:"ConflictPolicy"`
+
+	// IgnoreRules are gitignore-style patterns excluded from the sync, on top
+	// of any .mirrorboxignore files found in the tree.
+	IgnoreRules []string `json:"IgnoreRules"`
+
+	// SymlinkMode is "preserve" (default), "follow" or "skip".
+	// RewriteSymlinks points absolute links inside the source at the destination.
+	SymlinkMode     string `json:"SymlinkMode"`
+	RewriteSymlinks bool   `json:"RewriteSymlinks"`
+
+	// DeltaTransfer only rewrites the changed blocks of large modified files.
+	DeltaTransfer bool `json:"DeltaTransfer"`
+
+	// Concurrency is the number of parallel file transfers (0 = default).
+	Concurrency int `json:"Concurrency"`
+
+	// Versioning is "", "count", "days" or "staggered". VersionsKeep is the
+	// number of versions for "count" and the maximum age in days otherwise.
+	Versioning   string `json:"Versioning"`
+	VersionsKeep int    `json:"VersionsKeep"`
+
+	// RateLimit overrides the global bandwidth limit for this folder, in
+	// bytes per second (0 = use the global limit).
+	RateLimit int64 `json:"RateLimit"`
+
+	// Verify reads each copied file back and compares checksums.
+	Verify bool `json:"Verify"`
+
+	// Fsync flushes each written file and its directory to disk, so synced
+	// files survive a power loss.
+	Fsync bool `json:"Fsync"`
+
+	// Extra metadata to preserve beyond permissions and file times.
+	PreserveXattrs    bool `json:"PreserveXattrs"`
+	PreserveACLs      bool `json:"PreserveACLs"`
+	PreserveOwnership bool `json:"PreserveOwnership"`
+	PreserveDirTimes  bool `json:"PreserveDirTimes"`
+
+	// Streaming copies while the trees are still being walked, keeping
+	// memory flat for very large trees. One-way folders only.
+	Streaming bool `json:"Streaming"`
+
+	// IncrementalScan only lists directories that changed since the last
+	// run. Every FullRescanHours (0 = daily) all of them are listed again.
+	IncrementalScan bool `json:"IncrementalScan"`
+	FullRescanHours int  `json:"FullRescanHours"`
+
+	// Continuous watches the source and syncs changes as they happen, on
+	// top of the scheduled runs.
+	Continuous bool `json:"Continuous"`
+
+	// UnicodeNormalization is "none" (default), "nfc" or "nfd": the form of
+	// names written to the destination, which then matches names in either
+	// form. CaseInsensitive is for destinations that cannot store names only
+	// differing in letter case; such source names are reported as errors.
+	UnicodeNormalization string `json:"UnicodeNormalization"`
+	CaseInsensitive      bool   `json:"CaseInsensitive"`
+
+	// SanitizeNames encodes names that exFAT, FAT32 and Windows shares
+	// cannot store, such as names containing ':' or '?', ending in a dot,
+	// or reserved like CON.
+	SanitizeNames bool `json:"SanitizeNames"`
+}
+
+// StateKey returns a stable identifier for the folder pair, used to name
+// the directory holding its persistent sync state.
+func (f FolderToSync) StateKey() string {
+	sum := sha1.Sum([]byte(f.SourcePath + "\x00" + f.DestinationPath))
+	return hex.EncodeToString(sum[:8])
+}
+
+// RateWindow sets a different bandwidth limit between two times of day,
+// given as "HH:MM". A window ending before it starts wraps past midnight.
+type RateWindow struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Limit int64  `json:"limit"` // bytes per second, 0 = unlimited
 }
 
 // Config defines the application configuration structure.
@@ -13,6 +111,11 @@ type Config struct {
 	CheckInterval time.Duration  `json:"check_interval"`
 	StartAtBoot   bool           `json:"start_at_boot"`
 	Folders       []FolderToSync `json:"folders"`
+
+	// RateLimit caps the combined bandwidth of all jobs in bytes per
+	// second (0 = unlimited). RateSchedule overrides it at set times.
+	RateLimit    int64        `json:"rate_limit"`
+	RateSchedule []RateWindow `json:"rate_schedule"`
 }
 
 // DefaultConfig returns a sensible default configuration.
@@ -18,6 +18,12 @@ func NewStore(configPath string) *Store {
 	}
 }
 
+// Dir returns the directory holding the config file.
+// Per-job state is kept next to it.
+func (s *Store) Dir() string {
+	return filepath.Dir(s.configPath)
+}
+
 func (s *Store) Load() (*Config, error) {
 	data, err := os.ReadFile(s.configPath)
 
@@ -0,0 +1,161 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"excellgene.com/mirrorBox/internal/sync/fs"
+)
+
+// ConflictPolicy decides what happens to a file that changed on both sides,
+// or whose destination copy is newer than the source.
+type ConflictPolicy int
+
+const (
+	ConflictSourceWins ConflictPolicy = iota // overwrite the destination
+	ConflictNewestWins                       // keep whichever copy is newer
+	ConflictKeepBoth                         // rename the older copy, then sync
+	ConflictSkip                             // leave both copies alone
+)
+
+// ParseConflictPolicy converts a config value into a ConflictPolicy.
+// The empty string selects ConflictSourceWins.
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch s {
+	case "", "source-wins":
+		return ConflictSourceWins, nil
+	case "newest-wins":
+		return ConflictNewestWins, nil
+	case "keep-both":
+		return ConflictKeepBoth, nil
+	case "skip":
+		return ConflictSkip, nil
+	default:
+		return ConflictSourceWins, fmt.Errorf("unknown conflict policy: %q", s)
+	}
+}
+
+func (p ConflictPolicy) String() string {
+	switch p {
+	case ConflictNewestWins:
+		return "newest-wins"
+	case ConflictKeepBoth:
+		return "keep-both"
+	case ConflictSkip:
+		return "skip"
+	default:
+		return "source-wins"
+	}
+}
+
+// errConflictSkipped is returned for conflicts left alone by ConflictSkip.
+// The result lists the path as a warning rather than an error.
+var errConflictSkipped = errors.New("conflict skipped, both copies left in place")
+
+// isConflict reports whether the destination copy is newer than the source
+// and has different contents. Sizes are always compared; contents only when
+// a hash compare mode is active.
+func (d *Differ) isConflict(source, dest *fs.FileInfo) bool {
+	if source.IsDir || dest.IsDir || source.IsSymlink || dest.IsSymlink {
+		return false
+	}
+	if !d.newer(dest.ModTime, source.ModTime) {
+		return false
+	}
+
+	if source.Size != dest.Size {
+		return true
+	}
+
+	if d.Compare == CompareSizeModTime {
+		return false
+	}
+
+	return !d.sameContent(source, dest, d.Compare == CompareAlwaysHash)
+}
+
+// resolveConflict applies the syncer's conflict policy to one conflicting
+// path. One-way jobs never write to the source: when the destination copy
+// wins it is simply left in place.
+func (s *Syncer) resolveConflict(ctx context.Context, diff FileDiff, sourcePath, destPath string) (fs.CopyStats, error) {
+	var stats fs.CopyStats
+	if diff.Source == nil || diff.Dest == nil {
+		return stats, fmt.Errorf("no file info for conflict")
+	}
+	if diff.Source.IsDir || diff.Dest.IsDir {
+		return stats, fmt.Errorf("file and directory conflict, skipped")
+	}
+
+	sourceWins := diff.Source.ModTime >= diff.Dest.ModTime
+
+	switch s.conflicts {
+	case ConflictSkip:
+		return stats, errConflictSkipped
+
+	case ConflictSourceWins:
+		return s.update(ctx, diff, sourcePath, destPath)
+
+	case ConflictNewestWins:
+		if sourceWins {
+			return s.update(ctx, diff, sourcePath, destPath)
+		}
+		if s.twoWay {
+			return s.update(ctx, diff.reversed(), destPath, sourcePath)
+		}
+		return stats, nil
+
+	case ConflictKeepBoth:
+		if sourceWins || !s.twoWay {
+			if err := keepConflictCopy(destPath, diff.target()); err != nil {
+				return stats, err
+			}
+			return s.create(ctx, diff, sourcePath, destPath)
+		}
+		if err := keepConflictCopy(sourcePath, diff.Path); err != nil {
+			return stats, err
+		}
+		return s.create(ctx, diff.reversed(), destPath, sourcePath)
+	}
+
+	return stats, fmt.Errorf("unknown conflict policy: %v", s.conflicts)
+}
+
+// keepConflictCopy moves root/path aside to its conflict name.
+func keepConflictCopy(root, path string) error {
+	oldPath := filepath.Join(root, path)
+	newPath := filepath.Join(root, conflictName(path, time.Now()))
+
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return fmt.Errorf("keep conflict copy: %w", err)
+	}
+
+	return nil
+}
+
+// conflictName returns name.conflict-<host>-<timestamp>.ext for path.
+func conflictName(path string, t time.Time) string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "unknown"
+	}
+	host = strings.ReplaceAll(host, string(filepath.Separator), "_")
+
+	ext := filepath.Ext(path)
+	if ext == filepath.Base(path) {
+		ext = "" // dotfile such as .profile
+	}
+	base := strings.TrimSuffix(path, ext)
+
+	return fmt.Sprintf("%s.conflict-%s-%s%s", base, host, t.Format("20060102-150405"), ext)
+}
+
+// isConflictCopy reports whether path was created by ConflictKeepBoth.
+// Mirror runs never delete these copies.
+func isConflictCopy(path string) bool {
+	return strings.Contains(filepath.Base(path), ".conflict-")
+}
@@ -1,6 +1,11 @@
 package sync
 
 import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
 	"excellgene.com/mirrorBox/internal/sync/fs"
 )
 
@@ -12,22 +17,184 @@ const (
 	ActionCreate
 	ActionUpdate
 	ActionDelete
+
+	// Two-way jobs also write back to the source side.
+	ActionCreateSource
+	ActionUpdateSource
+	ActionDeleteSource
+
+	// ActionConflict marks a path changed on both sides since the last sync,
+	// or whose destination copy is newer than the source.
+	ActionConflict
+
+	// ActionMove renames the destination copy of a file that was moved in
+	// the source. Dest describes the entry at its old path.
+	ActionMove
 )
 
+func (a Action) String() string {
+	switch a {
+	case ActionCreate:
+		return "create"
+	case ActionUpdate:
+		return "update"
+	case ActionDelete:
+		return "delete"
+	case ActionCreateSource:
+		return "create in source"
+	case ActionUpdateSource:
+		return "update in source"
+	case ActionDeleteSource:
+		return "delete in source"
+	case ActionConflict:
+		return "conflict"
+	case ActionMove:
+		return "move"
+	default:
+		return "none"
+	}
+}
+
+// CompareMode selects how the differ decides that a file has changed.
+type CompareMode int
+
+const (
+	CompareSizeModTime CompareMode = iota // size and modification time only
+	CompareHash                           // size and mtime, then a cached content hash
+	CompareAlwaysHash                     // size, then a freshly computed content hash
+)
+
+// ParseCompareMode converts a config value into a CompareMode.
+// The empty string selects the default size and modification time check.
+func ParseCompareMode(s string) (CompareMode, error) {
+	switch s {
+	case "", "size-mtime":
+		return CompareSizeModTime, nil
+	case "hash":
+		return CompareHash, nil
+	case "always-hash":
+		return CompareAlwaysHash, nil
+	default:
+		return CompareSizeModTime, fmt.Errorf("unknown compare mode: %q", s)
+	}
+}
+
+func (m CompareMode) String() string {
+	switch m {
+	case CompareHash:
+		return "hash"
+	case CompareAlwaysHash:
+		return "always-hash"
+	default:
+		return "size-mtime"
+	}
+}
+
 type FileDiff struct {
 	Path   string
 	Action Action
 	Source *fs.FileInfo
 	Dest   *fs.FileInfo
+
+	// DestPath is the path written at the destination when it differs from
+	// Path, because the destination entry or the name it is given there
+	// uses another Unicode form or letter case. Empty means Path.
+	DestPath string
+}
+
+// target returns the path of the diff at the destination.
+func (d FileDiff) target() string {
+	if d.DestPath != "" {
+		return d.DestPath
+	}
+	return d.Path
+}
+
+// reversed swaps the roles of source and destination, so a change made at
+// the destination can be applied to the source with the same code paths.
+func (d FileDiff) reversed() FileDiff {
+	r := FileDiff{
+		Path:   d.target(),
+		Action: d.Action,
+		Source: d.Dest,
+		Dest:   d.Source,
+	}
+	if r.Path != d.Path {
+		r.DestPath = d.Path
+	}
+	return r
 }
 
 type DiffResult struct {
 	Diffs []FileDiff
+
+	// Links maps each hard-linked source file to the first path of its
+	// link group. The destination copy of that path is linked, not copied.
+	Links map[string]string
+
+	// DestPaths maps source paths to their destination entry when its name
+	// differs, whether or not the path has a diff.
+	DestPaths map[string]string
+
+	// Skipped maps paths left out of the diff for their name to the reason:
+	// a *NameCollisionError or an *fs.NameError.
+	Skipped map[string]error
+}
+
+// destPath returns the destination path of the source path.
+func (r *DiffResult) destPath(path string) string {
+	if p, ok := r.DestPaths[path]; ok {
+		return p
+	}
+	return path
 }
 
 // Differ compares source and destination filesystems.
 type Differ struct {
 	DeleteExtraFiles bool
+
+	// Compare selects the change detection strategy. The hash based modes
+	// need SourceRoot, DestRoot and Checksums to locate and cache digests.
+	Compare    CompareMode
+	Checksums  *fs.ChecksumCache
+	SourceRoot string
+	DestRoot   string
+
+	// RewriteLinks compares absolute symlink targets inside SourceRoot as
+	// if they pointed to the same place below DestRoot.
+	RewriteLinks bool
+
+	// DirTimes treats a directory whose modification time differs from the
+	// source as changed, so its metadata is copied again.
+	DirTimes bool
+
+	// Inodes, when set, is used to turn a create and a delete of the same
+	// moved file into an ActionMove. Only mirroring jobs produce moves.
+	Inodes *InodeMap
+
+	// Normalization matches names in either Unicode form and gives new
+	// destination entries the selected one. FoldCase matches names that
+	// only differ in letter case, for destinations that cannot hold both.
+	// Source paths that end up sharing a destination name are skipped.
+	Normalization fs.Normalization
+	FoldCase      bool
+
+	// Sanitize gives new destination entries names that Windows, exFAT and
+	// FAT32 can store. Names, when set, holds the source paths of entries
+	// named that way by earlier runs, so they are matched again.
+	Sanitize bool
+	Names    *NameMap
+
+	// ModTimeTolerance is how far apart modification times may be and
+	// still count as equal, for destinations that store them coarsely,
+	// such as the 2s of FAT. Times are compared in whole seconds, so
+	// tolerances below 2s make no difference.
+	ModTimeTolerance time.Duration
+
+	// MaxNameLength, when set, is the longest name in bytes the
+	// destination can store. Longer new names are skipped with an
+	// *fs.NameError.
+	MaxNameLength int
 }
 
 // NewDiffer creates a new differ with default settings.
@@ -40,69 +207,140 @@ func NewDiffer() *Differ {
 // Diff compares source and destination file lists.
 // Returns list of actions needed to sync dest to match source.
 func (d *Differ) Diff(source, dest []fs.FileInfo) *DiffResult {
-	sourceMap := make(map[string]fs.FileInfo)
-	destMap := make(map[string]fs.FileInfo)
-
-	// Build lookup maps
-	for _, f := range source {
-		sourceMap[f.Path] = f
-	}
-	for _, f := range dest {
-		destMap[f.Path] = f
-	}
+	sourceMap, skipped := d.sourceMap(source)
+	destMap, destExtra := d.destMap(dest, sourceMap)
+	destPaths := d.destPaths(sourceMap, destMap, skipped)
 
 	var diffs []FileDiff
 
-	for path, srcFile := range sourceMap {
-		destFile, existsAtDest := destMap[path]
+	for key, srcFile := range sourceMap {
+		destFile, existsAtDest := destMap[key]
 
 		if !existsAtDest {
 			diffs = append(diffs, FileDiff{
-				Path:   path,
-				Action: ActionCreate,
-				Source: &srcFile,
-				Dest:   nil,
+				Path:     srcFile.Path,
+				Action:   ActionCreate,
+				Source:   &srcFile,
+				Dest:     nil,
+				DestPath: destPaths[srcFile.Path],
 			})
-		} else if d.needsUpdate(srcFile, destFile) {
+		} else if action := d.compare(&srcFile, &destFile); action != ActionNone {
 			diffs = append(diffs, FileDiff{
-				Path:   path,
-				Action: ActionUpdate,
-				Source: &srcFile,
-				Dest:   &destFile,
+				Path:     srcFile.Path,
+				Action:   action,
+				Source:   &srcFile,
+				Dest:     &destFile,
+				DestPath: destPaths[srcFile.Path],
 			})
 		}
 	}
 
 	if d.DeleteExtraFiles {
-		for path, destFile := range destMap {
-			if _, existsAtSource := sourceMap[path]; !existsAtSource {
-				diffs = append(diffs, FileDiff{
-					Path:   path,
-					Action: ActionDelete,
-					Source: nil,
-					Dest:   &destFile,
-				})
+		for key, destFile := range destMap {
+			if _, existsAtSource := sourceMap[key]; !existsAtSource {
+				destExtra = append(destExtra, destFile)
 			}
 		}
+		for _, destFile := range destExtra {
+			if isConflictCopy(destFile.Path) {
+				continue
+			}
+			diffs = append(diffs, FileDiff{
+				Path:   destFile.Path,
+				Action: ActionDelete,
+				Source: nil,
+				Dest:   &destFile,
+			})
+		}
+
+		if d.Inodes != nil {
+			diffs = d.detectMoves(diffs)
+		}
 	}
 
-	return &DiffResult{Diffs: diffs}
+	return &DiffResult{
+		Diffs:     diffs,
+		Links:     hardLinkLeaders(source),
+		DestPaths: destPaths,
+		Skipped:   skipped,
+	}
+}
+
+// compare returns what to do about a path present on both sides:
+// ActionConflict, ActionUpdate or ActionNone.
+func (d *Differ) compare(source, dest *fs.FileInfo) Action {
+	switch {
+	case d.isConflict(source, dest):
+		return ActionConflict
+	case d.needsUpdate(source, dest):
+		return ActionUpdate
+	default:
+		return ActionNone
+	}
 }
 
 // needsUpdate determines if a file needs to be updated.
-// Currently uses modification time and size.
-func (d *Differ) needsUpdate(source, dest fs.FileInfo) bool {
+// A size change always counts; the compare mode decides the rest.
+// Digests computed along the way are stored on source and dest.
+func (d *Differ) needsUpdate(source, dest *fs.FileInfo) bool {
+	if source.IsSymlink || dest.IsSymlink {
+		return d.linkChanged(source, dest)
+	}
+
 	if source.IsDir {
-		return false
+		return d.DirTimes && dest.IsDir && !d.sameTime(source.ModTime, dest.ModTime)
 	}
 
 	if source.Size != dest.Size {
 		return true
 	}
 
-	if source.ModTime > dest.ModTime {
-		return true
+	switch d.Compare {
+	case CompareHash:
+		if d.newer(source.ModTime, dest.ModTime) {
+			return true
+		}
+		return !d.sameContent(source, dest, false)
+
+	case CompareAlwaysHash:
+		return !d.sameContent(source, dest, true)
+
+	default:
+		return d.newer(source.ModTime, dest.ModTime)
+	}
+}
+
+// newer reports whether modification time a, in seconds, is later than b
+// by more than the destination's timestamps can be off by.
+func (d *Differ) newer(a, b int64) bool {
+	return time.Duration(a-b)*time.Second >= max(d.ModTimeTolerance, time.Second)
+}
+
+// sameTime reports whether modification times a and b are equal within
+// the destination's precision.
+func (d *Differ) sameTime(a, b int64) bool {
+	return !d.newer(a, b) && !d.newer(b, a)
+}
+
+// sameContent compares the digests of both files. A file that cannot be
+// hashed is treated as changed so the copy reports the real error.
+func (d *Differ) sameContent(source, dest *fs.FileInfo, force bool) bool {
+	if d.Checksums == nil {
+		return false
+	}
+
+	var err error
+	source.Digest, err = d.Checksums.Digest(filepath.Join(d.SourceRoot, source.Path), force)
+	if err != nil {
+		log.Printf("Hash %s: %v", source.Path, err)
+		return false
+	}
+
+	dest.Digest, err = d.Checksums.Digest(filepath.Join(d.DestRoot, dest.Path), force)
+	if err != nil {
+		log.Printf("Hash %s: %v", dest.Path, err)
+		return false
 	}
 
-	return false
+	return source.Digest == dest.Digest
 }
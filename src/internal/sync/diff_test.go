@@ -0,0 +1,101 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"excellgene.com/mirrorBox/internal/sync/fs"
+)
+
+func TestDiffModTimeTolerance(t *testing.T) {
+	tests := []struct {
+		name      string
+		tolerance time.Duration
+		source    fs.FileInfo
+		dest      fs.FileInfo
+		want      Action
+	}{
+		{"newer source", 0, testFile("a", 1, 101), testFile("a", 1, 100), ActionUpdate},
+		{"newer source within tolerance", 2 * time.Second, testFile("a", 1, 101), testFile("a", 1, 100), ActionNone},
+		{"newer source past tolerance", 2 * time.Second, testFile("a", 1, 102), testFile("a", 1, 100), ActionUpdate},
+		{"newer destination", 0, testFile("a", 1, 100), testFile("a", 2, 101), ActionConflict},
+		{"newer destination within tolerance", 2 * time.Second, testFile("a", 1, 100), testFile("a", 2, 101), ActionUpdate},
+		{"size change within tolerance", 2 * time.Second, testFile("a", 2, 100), testFile("a", 1, 100), ActionUpdate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDiffer()
+			d.ModTimeTolerance = tt.tolerance
+
+			result := d.Diff([]fs.FileInfo{tt.source}, []fs.FileInfo{tt.dest})
+
+			got := ActionNone
+			if len(result.Diffs) == 1 {
+				got = result.Diffs[0].Action
+			}
+			if len(result.Diffs) > 1 || got != tt.want {
+				t.Errorf("got %v, want %v", result.Diffs, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffCompareHash(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	src, dst := filepath.Join(srcDir, "a"), filepath.Join(dstDir, "a")
+	mtime := time.Unix(1700000000, 0)
+	for path, data := range map[string]string{src: "aaaa", dst: "bbbb"} {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srcDigest, err := fs.HashFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := fs.NewChecksumCache("")
+	diff := func(compare CompareMode) Action {
+		t.Helper()
+		d := NewDiffer()
+		d.Compare = compare
+		d.SourceRoot, d.DestRoot, d.Checksums = srcDir, dstDir, cache
+		result := d.Diff([]fs.FileInfo{testFile("a", 4, mtime.Unix())}, []fs.FileInfo{testFile("a", 4, mtime.Unix())})
+		if len(result.Diffs) == 0 {
+			return ActionNone
+		}
+		return result.Diffs[0].Action
+	}
+
+	if got := diff(CompareHash); got != ActionUpdate {
+		t.Fatalf("different contents: got %v, want %v", got, ActionUpdate)
+	}
+
+	// A cached digest is trusted while the size and mtime still match
+	if err := cache.Record(dst, srcDigest); err != nil {
+		t.Fatal(err)
+	}
+	if got := diff(CompareHash); got != ActionNone {
+		t.Errorf("cached digest: got %v, want %v", got, ActionNone)
+	}
+	if got := diff(CompareAlwaysHash); got != ActionUpdate {
+		t.Errorf("forced hash: got %v, want %v", got, ActionUpdate)
+	}
+
+	// A sub-second mtime change is enough to hash the file again
+	if err := cache.Record(dst, srcDigest); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(dst, mtime, mtime.Add(500*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if got := diff(CompareHash); got != ActionUpdate {
+		t.Errorf("changed mtime: got %v, want %v", got, ActionUpdate)
+	}
+}
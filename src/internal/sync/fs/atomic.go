@@ -0,0 +1,67 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// atomicFile is written under a temporary name in the directory of its
+// destination, and renamed over it once complete, so the destination never
+// holds partly written contents under its final name.
+type atomicFile struct {
+	*os.File
+	path      string
+	committed bool
+}
+
+// createAtomic creates the temporary file new contents for path are
+// written to.
+func createAtomic(path string) (*atomicFile, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), ".mirrorbox-tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+	return &atomicFile{File: f, path: path}, nil
+}
+
+// commit moves the file over its destination. See replace for fsync.
+func (f *atomicFile) commit(fsync bool) error {
+	if err := replace(f.File, f.path, fsync); err != nil {
+		return err
+	}
+	f.committed = true
+	return nil
+}
+
+// discard removes the temporary file unless it was committed.
+func (f *atomicFile) discard() {
+	if f.committed {
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// replace closes f and renames it over path. With fsync set, the contents
+// are flushed to disk first and the directory entry after, so the file
+// survives a crash or power loss once replace returns.
+func replace(f *os.File, path string, fsync bool) error {
+	if fsync {
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("flush file: %w", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close temp file: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("rename temp file: %w", err)
+	}
+	if fsync {
+		if err := syncDir(filepath.Dir(path)); err != nil {
+			return fmt.Errorf("flush directory: %w", err)
+		}
+	}
+	return nil
+}
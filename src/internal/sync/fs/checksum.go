@@ -0,0 +1,163 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// HashFile returns the hex-encoded SHA-256 digest of a file's contents.
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("hash file: %w", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type checksumEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"` // nanoseconds, so same-second edits invalidate
+	Digest  string `json:"digest"`
+}
+
+// ChecksumCache remembers file digests keyed by absolute path, size and
+// modification time, so a file is only re-hashed when its metadata changes.
+// It is safe for concurrent use.
+type ChecksumCache struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]checksumEntry
+}
+
+// NewChecksumCache creates a cache persisted at path.
+// An empty path keeps the cache in memory only.
+func NewChecksumCache(path string) *ChecksumCache {
+	return &ChecksumCache{
+		path:    path,
+		entries: make(map[string]checksumEntry),
+	}
+}
+
+// Load reads the cache from disk. A missing file leaves the cache empty.
+func (c *ChecksumCache) Load() error {
+	if c.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("read checksum cache: %w", err)
+	}
+
+	entries := make(map[string]checksumEntry)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("parse checksum cache: %w", err)
+	}
+
+	c.mu.Lock()
+	c.entries = entries
+	c.mu.Unlock()
+
+	return nil
+}
+
+// Save writes the cache to disk.
+func (c *ChecksumCache) Save() error {
+	if c.path == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	data, err := json.Marshal(c.entries)
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("marshal checksum cache: %w", err)
+	}
+
+	if err := WriteStateFile(c.path, data); err != nil {
+		return fmt.Errorf("write checksum cache: %w", err)
+	}
+
+	return nil
+}
+
+// Digest returns the digest of the file at path, hashing it only when the
+// cached entry is missing or stale. force always re-hashes the file.
+func (c *ChecksumCache) Digest(path string, force bool) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("stat file: %w", err)
+	}
+
+	if !force {
+		c.mu.Lock()
+		entry, ok := c.entries[path]
+		c.mu.Unlock()
+
+		if ok && entry.Size == info.Size() && entry.ModTime == info.ModTime().UnixNano() {
+			return entry.Digest, nil
+		}
+	}
+
+	digest, err := HashFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.entries[path] = checksumEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Digest:  digest,
+	}
+	c.mu.Unlock()
+
+	return digest, nil
+}
+
+// Record stores a digest that is already known for the file at path,
+// e.g. the source digest after copying it to the destination.
+func (c *ChecksumCache) Record(path, digest string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("stat file: %w", err)
+	}
+
+	c.mu.Lock()
+	c.entries[path] = checksumEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Digest:  digest,
+	}
+	c.mu.Unlock()
+
+	return nil
+}
+
+// Retain drops every entry whose path is rejected by keep.
+func (c *ChecksumCache) Retain(keep func(path string) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for path := range c.entries {
+		if !keep(path) {
+			delete(c.entries, path)
+		}
+	}
+}
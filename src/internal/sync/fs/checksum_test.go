@@ -0,0 +1,67 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChecksumCacheDigest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a")
+	mtime := time.Unix(1700000000, 0)
+	write := func(data string, mtime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		data   string
+		mtime  time.Time
+		force  bool
+		cached bool // the recorded digest is returned instead of a new one
+	}{
+		{"unchanged", "aaaa", mtime, false, true},
+		{"forced", "aaaa", mtime, true, false},
+		{"size changed", "aaaaa", mtime, false, false},
+		{"mtime changed", "aaaa", mtime.Add(time.Second), false, false},
+		{"mtime changed within the second", "aaaa", mtime.Add(time.Millisecond), false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			write("aaaa", mtime)
+			c := NewChecksumCache("")
+			if err := c.Record(path, "recorded"); err != nil {
+				t.Fatal(err)
+			}
+			write(tt.data, tt.mtime)
+
+			got, err := c.Digest(path, tt.force)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := HashFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.cached {
+				want = "recorded"
+			}
+			if got != want {
+				t.Errorf("Digest() = %q, want %q", got, want)
+			}
+
+			// The new digest replaces the stale entry
+			if again, err := c.Digest(path, false); err != nil || again != got {
+				t.Errorf("second Digest() = %q, %v, want %q", again, err, got)
+			}
+		})
+	}
+}
@@ -1,19 +1,69 @@
 package fs
 
 import (
+	"context"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
 )
 
+// CopyStats describes the work a single copy did.
+type CopyStats struct {
+	// BytesWritten counts the data taken from the source. Blocks reused
+	// from an existing destination copy or shared by a reflink are not
+	// included.
+	BytesWritten int64
+
+	// BytesAllocated is the disk space the written file takes, which is
+	// less than its size when the source's holes were preserved.
+	BytesAllocated int64
+
+	// Method is how the data was copied. CopyNone when no file data was
+	// involved, such as for a directory.
+	Method CopyMethod
+}
+
+// CopyMethod is how a copy moved a file's data.
+type CopyMethod int
+
+const (
+	CopyNone      CopyMethod = iota
+	CopyBuffered             // read and written through a buffer
+	CopyReflink              // destination shares the source's blocks (FICLONE)
+	CopyFileRange            // copied inside the kernel with copy_file_range
+	CopySendfile             // copied inside the kernel with sendfile
+)
+
+func (m CopyMethod) String() string {
+	switch m {
+	case CopyBuffered:
+		return "buffered"
+	case CopyReflink:
+		return "reflink"
+	case CopyFileRange:
+		return "copy_file_range"
+	case CopySendfile:
+		return "sendfile"
+	default:
+		return "none"
+	}
+}
+
 type Copier interface {
-	Copy(srcPath, dstPath string) error
+	// Copy writes the contents of srcPath to dstPath, replacing it at once
+	// when complete. It gives up with ctx.Err() once ctx is cancelled.
+	Copy(ctx context.Context, srcPath, dstPath string) (CopyStats, error)
 }
 
 type LocalCopier struct {
 	preservePerms bool
 	bufferSize    int
+	limiter       *RateLimiter
+	verify        bool
+	metadata      MetadataOptions
+	fsync         bool
 }
 
 func NewLocalCopier(preservePerms bool) *LocalCopier {
@@ -23,35 +73,104 @@ func NewLocalCopier(preservePerms bool) *LocalCopier {
 	}
 }
 
-func (c *LocalCopier) Copy(srcPath, dstPath string) error {
+// SetRateLimiter throttles every copy made by c to the limiter's rate.
+// The limiter may be shared with other copiers. Nil removes the limit.
+func (c *LocalCopier) SetRateLimiter(limiter *RateLimiter) {
+	c.limiter = limiter
+}
+
+// throttle wraps r so that reads respect the copier's rate limit and fail
+// once ctx is cancelled.
+func (c *LocalCopier) throttle(ctx context.Context, r io.Reader) io.Reader {
+	if c.limiter == nil {
+		return &cancelReader{ctx: ctx, r: r}
+	}
+	return &throttledReader{ctx: ctx, r: r, limiter: c.limiter}
+}
+
+// SetFsync makes c flush every written file and its directory to disk
+// before reporting it copied.
+func (c *LocalCopier) SetFsync(fsync bool) {
+	c.fsync = fsync
+}
+
+func (c *LocalCopier) Copy(ctx context.Context, srcPath, dstPath string) (CopyStats, error) {
+	var stats CopyStats
+
 	srcFile, err := os.Open(srcPath)
 	if err != nil {
-		return fmt.Errorf("open source file: %w", err)
+		return stats, fmt.Errorf("open source file: %w", err)
 	}
 	defer srcFile.Close()
 
 	srcInfo, err := srcFile.Stat()
 	if err != nil {
-		return fmt.Errorf("stat source file: %w", err)
+		return stats, fmt.Errorf("stat source file: %w", err)
 	}
 
 	if srcInfo.IsDir() {
-		return os.MkdirAll(dstPath, srcInfo.Mode())
+		return stats, os.MkdirAll(dstPath, srcInfo.Mode())
 	}
 
 	dstDir := filepath.Dir(dstPath)
 	if err := os.MkdirAll(dstDir, 0755); err != nil {
-		return fmt.Errorf("create parent directories: %w", err)
+		return stats, fmt.Errorf("create parent directories: %w", err)
 	}
 
-	dstFile, err := os.Create(dstPath)
+	dstFile, err := createAtomic(dstPath)
+	if err != nil {
+		return stats, err
+	}
+	defer dstFile.discard()
+
+	var digest hash.Hash
+	sparse := isSparse(srcInfo)
+	stats.Method, stats.BytesWritten, err = c.copyFast(ctx, dstFile.File, srcFile, srcInfo.Size(), sparse)
+	switch {
+	case stats.Method != CopyNone:
+		// The data never reached us, so the digest is taken separately
+		if err == nil && c.verify {
+			digest, err = hashFrom(srcFile)
+		}
+	case sparse:
+		// Only the data is read, so the digest is taken separately
+		stats.Method = CopyBuffered
+		src := c.throttle(ctx, srcFile)
+		stats.BytesWritten, err = copySparse(dstFile.File, srcFile, src, srcInfo.Size())
+		if err == nil && c.verify {
+			digest, err = hashFrom(srcFile)
+		}
+	default:
+		stats.Method = CopyBuffered
+		var src io.Reader
+		src, digest = c.tee(c.throttle(ctx, srcFile))
+		stats.BytesWritten, err = io.Copy(dstFile, src)
+	}
 	if err != nil {
-		return fmt.Errorf("create destination file: %w", err)
+		return stats, fmt.Errorf("copy file contents: %w", err)
 	}
-	defer dstFile.Close()
 
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
-		return fmt.Errorf("copy file contents: %w", err)
+	if err := verifyWritten(dstFile.File, digest); err != nil {
+		return stats, err
+	}
+
+	if err := c.applyMetadata(srcPath, dstFile.Name(), srcInfo); err != nil {
+		return stats, err
+	}
+
+	stats.BytesAllocated = allocated(dstFile.File)
+	if err := dstFile.commit(c.fsync); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// applyMetadata copies the selected extended metadata, then the source
+// permissions and modification time. Ownership goes first because changing
+// it can clear the setuid and setgid bits.
+func (c *LocalCopier) applyMetadata(srcPath, dstPath string, srcInfo os.FileInfo) error {
+	if err := copyExtendedMetadata(srcPath, dstPath, srcInfo, c.metadata); err != nil {
+		return err
 	}
 
 	if c.preservePerms {
@@ -67,14 +186,14 @@ func (c *LocalCopier) Copy(srcPath, dstPath string) error {
 	return nil
 }
 
-func ExecuteCopy(c Copier, srcPath, dstPath string) error {
+func ExecuteCopy(ctx context.Context, c Copier, srcPath, dstPath string) error {
 	if exists, err := Exists(srcPath); err != nil {
 		return fmt.Errorf("check source exists: %w", err)
 	} else if !exists {
 		return fmt.Errorf("source path does not exist: %s", srcPath)
 	}
 
-	if err := c.Copy(srcPath, dstPath); err != nil {
+	if _, err := c.Copy(ctx, srcPath, dstPath); err != nil {
 		return fmt.Errorf("copy failed: %w", err)
 	}
 
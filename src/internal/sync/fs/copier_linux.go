@@ -0,0 +1,81 @@
+//go:build linux
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// kernelChunk is the most data copy_file_range and sendfile are asked to
+// move at once, so cancellation and rate limits apply between calls.
+const kernelChunk = 1 << 20
+
+// copyFast copies size bytes of src to dst without reading them into
+// memory, trying in order a reflink sharing the source's blocks,
+// copy_file_range and sendfile, and the bytes it wrote, which are none for
+// a reflink. It returns CopyNone, with nothing written, when none of them
+// works here, and the caller copies through a buffer. Sparse sources are
+// only cloned, as the others would fill in the holes.
+func (c *LocalCopier) copyFast(ctx context.Context, dst, src *os.File, size int64, sparse bool) (CopyMethod, int64, error) {
+	// A cancelled copy is left to fail in the buffered one
+	if size == 0 || ctx.Err() != nil {
+		return CopyNone, 0, nil
+	}
+
+	if unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())) == nil {
+		return CopyReflink, 0, nil
+	}
+	if sparse {
+		return CopyNone, 0, nil
+	}
+
+	for _, method := range []CopyMethod{CopyFileRange, CopySendfile} {
+		written, err := c.copyKernel(ctx, dst, src, size, method)
+		if written > 0 || ctx.Err() != nil {
+			return method, written, err
+		}
+		// Nothing was written, so the next method starts afresh
+	}
+	return CopyNone, 0, nil
+}
+
+// copyKernel copies up to size bytes from the current offset of src to
+// that of dst with copy_file_range or sendfile. It stops early when the
+// source ends sooner.
+func (c *LocalCopier) copyKernel(ctx context.Context, dst, src *os.File, size int64, method CopyMethod) (int64, error) {
+	var written int64
+	for written < size {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+
+		n := int(min(kernelChunk, size-written))
+		var err error
+		if method == CopyFileRange {
+			n, err = unix.CopyFileRange(int(src.Fd()), nil, int(dst.Fd()), nil, n, 0)
+		} else {
+			n, err = unix.Sendfile(int(dst.Fd()), int(src.Fd()), nil, n)
+		}
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			break
+		}
+		written += int64(n)
+
+		if c.limiter != nil {
+			if err := c.limiter.Wait(ctx, n); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,79 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyCancelled(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, make([]byte, 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, limiter := range []*RateLimiter{nil, NewRateLimiter(1024)} {
+		c := NewLocalCopier(true)
+		c.SetRateLimiter(limiter)
+		if _, err := c.Copy(ctx, src, filepath.Join(dir, "dst")); !errors.Is(err, context.Canceled) {
+			t.Errorf("limiter %v: got %v, want context.Canceled", limiter != nil, err)
+		}
+	}
+
+	// Nothing is left behind, under the final name or a temporary one
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("cancelled copies left %d entries next to the source", len(entries)-1)
+	}
+}
+
+func TestCopyMethods(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	data := make([]byte, 3<<20+17)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, limiter := range []*RateLimiter{nil, NewRateLimiter(1 << 30)} {
+		c := NewLocalCopier(true)
+		c.SetRateLimiter(limiter)
+		c.SetVerify(true)
+		c.SetFsync(limiter != nil)
+		dst := filepath.Join(dir, "dst")
+		stats, err := c.Copy(context.Background(), src, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Method == CopyNone {
+			t.Errorf("limiter %v: no copy method recorded", limiter != nil)
+		}
+		want := int64(len(data))
+		if stats.Method == CopyReflink {
+			want = 0 // the blocks are shared, not written
+		}
+		if stats.BytesWritten != want {
+			t.Errorf("limiter %v: %s wrote %d bytes, want %d", limiter != nil, stats.Method, stats.BytesWritten, want)
+		}
+		got, err := os.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("limiter %v: %s copy differs from the source", limiter != nil, stats.Method)
+		}
+	}
+}
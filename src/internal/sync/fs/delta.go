@@ -0,0 +1,265 @@
+package fs
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+const (
+	minDeltaBlock = 4 * 1024
+	maxDeltaBlock = 128 * 1024
+	deltaChunk    = 1024 * 1024 // source bytes buffered at a time
+)
+
+// DeltaCopier is implemented by copiers that can rebuild a file from an
+// older copy of it, taking only the changed blocks from the source.
+type DeltaCopier interface {
+	// CopyDelta writes the contents of srcPath to dstPath, reusing matching
+	// blocks of basisPath, which may be dstPath itself, and replaces
+	// dstPath at once when complete. BytesWritten in the result counts
+	// only the literal data taken from the source.
+	CopyDelta(ctx context.Context, srcPath, basisPath, dstPath string) (CopyStats, error)
+}
+
+// blockSignature identifies one block of the basis file.
+type blockSignature struct {
+	index  int64
+	strong [sha256.Size]byte
+}
+
+// deltaBlockSize picks a block size around the square root of the file
+// size, as rsync does, within sane bounds.
+func deltaBlockSize(size int64) int {
+	bs := int(math.Sqrt(float64(size)))
+	bs = (bs + 1023) &^ 1023
+	return min(max(bs, minDeltaBlock), maxDeltaBlock)
+}
+
+// rollingSum is the rsync weak checksum over a window of bytes.
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingSum(block []byte) rollingSum {
+	r := rollingSum{n: uint32(len(block))}
+	for i, c := range block {
+		r.a += uint32(c)
+		r.b += uint32(len(block)-i) * uint32(c)
+	}
+	return r
+}
+
+// roll moves the window one byte forward.
+func (r *rollingSum) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r rollingSum) sum() uint32 {
+	return (r.a & 0xffff) | (r.b << 16)
+}
+
+// signatures reads the basis file and indexes its full blocks by weak sum.
+func signatures(basis io.Reader, blockSize int) (map[uint32][]blockSignature, error) {
+	sigs := make(map[uint32][]blockSignature)
+	r := bufio.NewReaderSize(basis, deltaChunk)
+	block := make([]byte, blockSize)
+
+	for index := int64(0); ; index++ {
+		if _, err := io.ReadFull(r, block); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return sigs, nil // a short final block is never matched
+			}
+			return nil, err
+		}
+
+		weak := newRollingSum(block).sum()
+		sigs[weak] = append(sigs[weak], blockSignature{index: index, strong: sha256.Sum256(block)})
+	}
+}
+
+// CopyDelta rebuilds dstPath from srcPath, copying blocks that already
+// exist in basisPath from there instead of from the source.
+func (c *LocalCopier) CopyDelta(ctx context.Context, srcPath, basisPath, dstPath string) (CopyStats, error) {
+	stats := CopyStats{Method: CopyBuffered}
+
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return stats, fmt.Errorf("open source file: %w", err)
+	}
+	defer srcFile.Close()
+
+	srcInfo, err := srcFile.Stat()
+	if err != nil {
+		return stats, fmt.Errorf("stat source file: %w", err)
+	}
+
+	basisFile, err := os.Open(basisPath)
+	if err != nil {
+		return stats, fmt.Errorf("open basis file: %w", err)
+	}
+	defer basisFile.Close()
+
+	basisInfo, err := basisFile.Stat()
+	if err != nil {
+		return stats, fmt.Errorf("stat basis file: %w", err)
+	}
+
+	blockSize := deltaBlockSize(basisInfo.Size())
+	sigs, err := signatures(basisFile, blockSize)
+	if err != nil {
+		return stats, fmt.Errorf("read basis signatures: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return stats, fmt.Errorf("create parent directories: %w", err)
+	}
+
+	dstFile, err := createAtomic(dstPath)
+	if err != nil {
+		return stats, err
+	}
+	defer dstFile.discard()
+
+	src, digest := c.tee(c.throttle(ctx, srcFile))
+	w := bufio.NewWriterSize(dstFile, deltaChunk)
+	written, err := applyDelta(src, basisFile, sigs, blockSize, w)
+	if err != nil {
+		return stats, fmt.Errorf("apply delta: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return stats, fmt.Errorf("write destination file: %w", err)
+	}
+	stats.BytesWritten = written
+
+	if err := verifyWritten(dstFile.File, digest); err != nil {
+		return stats, err
+	}
+
+	if err := c.applyMetadata(srcPath, dstFile.Name(), srcInfo); err != nil {
+		return stats, err
+	}
+
+	// The basis may be dstPath itself, which is replaced now
+	basisFile.Close()
+	stats.BytesAllocated = allocated(dstFile.File)
+	if err := dstFile.commit(c.fsync); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// applyDelta streams src through a rolling window, writing matched basis
+// blocks and literal source data to w. It returns the literal byte count.
+func applyDelta(src io.Reader, basis io.ReaderAt, sigs map[uint32][]blockSignature, blockSize int, w io.Writer) (int64, error) {
+	var literal int64
+
+	data := make([]byte, 0, 2*deltaChunk+blockSize)
+	block := make([]byte, blockSize)
+	pos, lit := 0, 0 // window start and start of pending literal data
+	eof := false
+
+	var sum rollingSum
+	valid := false
+
+	flushLiteral := func() error {
+		if pos > lit {
+			n, err := w.Write(data[lit:pos])
+			literal += int64(n)
+			if err != nil {
+				return err
+			}
+		}
+		lit = pos
+		return nil
+	}
+
+	// fill makes sure the window plus one byte is buffered, unless at EOF.
+	fill := func() error {
+		for !eof && len(data)-pos <= blockSize {
+			if lit > 0 {
+				n := copy(data, data[lit:])
+				data = data[:n]
+				pos -= lit
+				lit = 0
+			}
+			n, err := src.Read(data[len(data):cap(data)])
+			data = data[:len(data)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for {
+		if err := fill(); err != nil {
+			return literal, err
+		}
+		if len(data)-pos < blockSize {
+			break
+		}
+
+		window := data[pos : pos+blockSize]
+		if !valid {
+			sum = newRollingSum(window)
+			valid = true
+		}
+
+		if cands, ok := sigs[sum.sum()]; ok {
+			strong := sha256.Sum256(window)
+			for _, cand := range cands {
+				if cand.strong != strong {
+					continue
+				}
+				if err := flushLiteral(); err != nil {
+					return literal, err
+				}
+				if _, err := basis.ReadAt(block, cand.index*int64(blockSize)); err != nil {
+					return literal, err
+				}
+				if _, err := w.Write(block); err != nil {
+					return literal, err
+				}
+				pos += blockSize
+				lit = pos
+				valid = false
+				break
+			}
+			if !valid {
+				continue
+			}
+		}
+
+		if pos+blockSize < len(data) {
+			sum.roll(data[pos], data[pos+blockSize])
+		} else {
+			valid = false
+		}
+		pos++
+
+		// Keep the buffer bounded on long runs without matches
+		if pos-lit >= deltaChunk {
+			if err := flushLiteral(); err != nil {
+				return literal, err
+			}
+		}
+	}
+
+	// Whatever is left is shorter than a block and goes out as literal data
+	pos = len(data)
+	if err := flushLiteral(); err != nil {
+		return literal, err
+	}
+
+	return literal, nil
+}
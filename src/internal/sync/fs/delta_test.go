@@ -0,0 +1,106 @@
+package fs
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestRollingSum(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	data := randomBytes(r, 1000)
+	const window = 37
+
+	sum := newRollingSum(data[:window])
+	for i := 1; i+window <= len(data); i++ {
+		sum.roll(data[i-1], data[i+window-1])
+		if want := newRollingSum(data[i : i+window]).sum(); sum.sum() != want {
+			t.Fatalf("offset %d: rolled sum %08x, want %08x", i, sum.sum(), want)
+		}
+	}
+}
+
+func TestApplyDelta(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	const bs = 64
+
+	basis := randomBytes(r, 100*bs+17) // ends in a short block
+	large := randomBytes(r, 3*deltaChunk)
+
+	tests := []struct {
+		name       string
+		basis      []byte
+		src        []byte
+		blockSize  int
+		maxLiteral int64 // -1 = the whole source
+	}{
+		{"identical", basis, basis, bs, 17},
+		{"empty source", basis, nil, bs, 0},
+		{"empty basis", nil, basis, bs, -1},
+		{"basis smaller than a block", basis[:bs/2], basis[:bs/2], bs, bs / 2},
+		{"source smaller than a block", basis, basis[:bs-1], bs, bs - 1},
+		{"insertion", basis, concat(basis[:50*bs+3], []byte("inserted"), basis[50*bs+3:]), bs, 2*bs + 8 + 17},
+		{"deletion", basis, concat(basis[:30*bs], basis[31*bs+5:]), bs, 2*bs + 17},
+		{"prefix added", basis, concat([]byte("header"), basis), bs, 6 + 17},
+		{"blocks reordered", basis, concat(basis[60*bs:100*bs], basis[:60*bs]), bs, 0},
+		{"short final block changed", basis, concat(basis[:100*bs], []byte("tail")), bs, 4},
+		{"unrelated", basis, randomBytes(r, 50*bs), bs, -1},
+		{"long literal run", large[:bs], large, minDeltaBlock, -1},
+		{"match after long literal run", large, concat(randomBytes(r, deltaChunk+3), large), minDeltaBlock, deltaChunk + 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sigs, err := signatures(bytes.NewReader(tt.basis), tt.blockSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out bytes.Buffer
+			literal, err := applyDelta(bytes.NewReader(tt.src), bytes.NewReader(tt.basis), sigs, tt.blockSize, &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(out.Bytes(), tt.src) {
+				t.Fatalf("rebuilt %d bytes that differ from the %d source bytes", out.Len(), len(tt.src))
+			}
+
+			want := tt.maxLiteral
+			if want < 0 {
+				want = int64(len(tt.src))
+			}
+			if literal > want {
+				t.Errorf("sent %d literal bytes, want at most %d", literal, want)
+			}
+		})
+	}
+}
+
+func TestDeltaBlockSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int
+	}{
+		{0, minDeltaBlock},
+		{1 << 20, minDeltaBlock},
+		{1 << 30, 32 * 1024},
+		{1 << 40, maxDeltaBlock},
+	}
+
+	for _, tt := range tests {
+		if got := deltaBlockSize(tt.size); got != tt.want {
+			t.Errorf("deltaBlockSize(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
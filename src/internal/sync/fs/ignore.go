@@ -0,0 +1,198 @@
+package fs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFileName is the per-directory file holding extra ignore rules.
+const IgnoreFileName = ".mirrorboxignore"
+
+type ignoreRule struct {
+	base    string // slash-separated directory the rule was defined in, "" for the root
+	pattern *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// IgnoreRules is an ordered list of gitignore-style patterns. As in git,
+// the last matching rule wins and "!" re-includes a previously excluded path.
+// The zero value ignores nothing.
+type IgnoreRules struct {
+	rules []ignoreRule
+}
+
+// ParseIgnoreRules compiles gitignore-style lines that apply from the root
+// of the walked tree.
+func ParseIgnoreRules(lines []string) (*IgnoreRules, error) {
+	return (&IgnoreRules{}).with("", lines)
+}
+
+// with returns a copy of r extended by the rules in lines, which apply to
+// paths below base.
+func (r *IgnoreRules) with(base string, lines []string) (*IgnoreRules, error) {
+	next := &IgnoreRules{rules: append([]ignoreRule(nil), r.rules...)}
+
+	for _, line := range lines {
+		rule, ok, err := parseIgnoreLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("ignore rule %q: %w", line, err)
+		}
+		if !ok {
+			continue
+		}
+		rule.base = base
+		next.rules = append(next.rules, rule)
+	}
+
+	return next, nil
+}
+
+// Match reports whether the slash-separated relative path is ignored.
+func (r *IgnoreRules) Match(relPath string, isDir bool) bool {
+	if r == nil {
+		return false
+	}
+
+	ignored := false
+	for _, rule := range r.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		p := relPath
+		if rule.base != "" {
+			if !strings.HasPrefix(relPath, rule.base+"/") {
+				continue
+			}
+			p = strings.TrimPrefix(relPath, rule.base+"/")
+		}
+
+		if rule.pattern.MatchString(p) {
+			ignored = !rule.negate
+		}
+	}
+
+	return ignored
+}
+
+// loadIgnoreFile extends r with the rules in dir's ignore file, if any.
+// base is dir relative to the walk root.
+func (r *IgnoreRules) loadIgnoreFile(dir, base string) (*IgnoreRules, error) {
+	f, err := os.Open(filepath.Join(dir, IgnoreFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+		return nil, fmt.Errorf("open %s: %w", IgnoreFileName, err)
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", IgnoreFileName, err)
+	}
+
+	return r.with(base, lines)
+}
+
+// parseIgnoreLine compiles one line. ok is false for blanks and comments.
+func parseIgnoreLine(line string) (rule ignoreRule, ok bool, err error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false, nil
+	}
+
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return rule, false, nil
+	}
+
+	// A slash anywhere but at the end anchors the pattern to its base dir.
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	expr := globToRegexp(line)
+	if anchored {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "^(?:.*/)?" + expr + "$"
+	}
+
+	rule.pattern, err = regexp.Compile(expr)
+	if err != nil {
+		return rule, false, err
+	}
+
+	return rule, true, nil
+}
+
+// globToRegexp translates gitignore glob syntax, including "**", into a
+// regular expression over slash-separated paths.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				atStart := i == 0 || glob[i-1] == '/'
+				switch {
+				case atStart && i+2 < len(glob) && glob[i+2] == '/':
+					b.WriteString("(?:.*/)?") // "**/" matches zero or more directories
+					i += 2
+				case atStart && i+2 == len(glob):
+					b.WriteString(".*") // trailing "/**" matches everything inside
+					i++
+				default:
+					b.WriteString("[^/]*")
+					i++
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return b.String()
+}
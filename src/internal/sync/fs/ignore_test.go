@@ -0,0 +1,114 @@
+package fs
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob  string
+		match []string
+		miss  []string
+	}{
+		{"*.log", []string{"a.log", ".log"}, []string{"a.log.1", "dir/a.log"}},
+		{"a?c", []string{"abc", "a.c"}, []string{"ac", "a/c", "abbc"}},
+		{"[ab].txt", []string{"a.txt", "b.txt"}, []string{"c.txt"}},
+		{"[!ab].txt", []string{"c.txt"}, []string{"a.txt"}},
+		{"[a-c]x", []string{"bx"}, []string{"dx"}},
+		{"**/build", []string{"build", "a/build", "a/b/build"}, []string{"abuild"}},
+		{"logs/**", []string{"logs/a", "logs/a/b"}, []string{"logs", "xlogs/a"}},
+		{"a/**/b", []string{"a/b", "a/x/b", "a/x/y/b"}, []string{"ab", "a/xb"}},
+		{"a**b", []string{"ab", "axxb"}, []string{"a/b"}},
+		{`\*.txt`, []string{"*.txt"}, []string{"a.txt"}},
+		{"a+b(c).txt", []string{"a+b(c).txt"}, []string{"aab(c).txt"}},
+		{"[abc", []string{"[abc"}, []string{"a"}},
+	}
+
+	for _, tt := range tests {
+		re := regexp.MustCompile("^" + globToRegexp(tt.glob) + "$")
+		for _, s := range tt.match {
+			if !re.MatchString(s) {
+				t.Errorf("%q should match %q", tt.glob, s)
+			}
+		}
+		for _, s := range tt.miss {
+			if re.MatchString(s) {
+				t.Errorf("%q should not match %q", tt.glob, s)
+			}
+		}
+	}
+}
+
+func TestIgnoreRulesMatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []string
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"no rules", nil, "a.txt", false, false},
+		{"basename anywhere", []string{"*.swp"}, "a/b/c.swp", false, true},
+		{"anchored by leading slash", []string{"/build"}, "build", true, true},
+		{"anchored not nested", []string{"/build"}, "src/build", true, false},
+		{"inner slash anchors", []string{"doc/*.md"}, "doc/a.md", false, true},
+		{"inner slash not nested", []string{"doc/*.md"}, "x/doc/a.md", false, false},
+		{"dir only matches dir", []string{"cache/"}, "cache", true, true},
+		{"dir only skips file", []string{"cache/"}, "cache", false, false},
+		{"negation re-includes", []string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{"last rule wins", []string{"!keep.log", "*.log"}, "keep.log", false, true},
+		{"comments and blanks", []string{"# *.txt", "", "   "}, "a.txt", false, false},
+		{"escaped hash", []string{`\#notes`}, "#notes", false, true},
+		{"escaped bang", []string{`\!important`}, "!important", false, true},
+		{"trailing spaces trimmed", []string{"a.txt   "}, "a.txt", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := ParseIgnoreRules(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rules.Match(tt.path, tt.isDir); got != tt.want {
+				t.Errorf("Match(%q, %v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIgnoreRulesBase(t *testing.T) {
+	root, err := ParseIgnoreRules([]string{"*.tmp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := root.with("sub", []string{"/local", "!keep.tmp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"a.tmp", true},
+		{"sub/a.tmp", true},
+		{"sub/keep.tmp", false},
+		{"other/keep.tmp", true},
+		{"sub/local", true},
+		{"local", false},
+		{"sub/x/local", false},
+	}
+
+	for _, tt := range tests {
+		if got := sub.Match(tt.path, false); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParseIgnoreRulesError(t *testing.T) {
+	if _, err := ParseIgnoreRules([]string{"[z-a]"}); err == nil {
+		t.Error("expected an error for an invalid character range")
+	}
+}
@@ -0,0 +1,194 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// DefaultFullRescan is how often an incremental walk lists every
+// directory again when no other interval is set.
+const DefaultFullRescan = 24 * time.Hour
+
+// racyWindow is how long a directory must have been left alone before its
+// listing is trusted. A change made in the same timestamp tick as the
+// listing, or stamped by a network server whose clock runs behind, would
+// otherwise leave the directory looking unchanged.
+const racyWindow = 10 * time.Second
+
+// dirEntry is one entry of a directory listing, as recorded in an Index.
+type dirEntry struct {
+	Name       string      `json:"name"`
+	Mode       os.FileMode `json:"mode"`
+	Size       int64       `json:"size"`
+	ModTime    int64       `json:"mtime"` // nanoseconds
+	ChangeTime int64       `json:"ctime,omitempty"`
+	Dev        uint64      `json:"dev,omitempty"`
+	Ino        uint64      `json:"ino,omitempty"`
+	Nlink      uint64      `json:"nlink,omitempty"`
+}
+
+func newDirEntry(info os.FileInfo) dirEntry {
+	e := dirEntry{
+		Name:       info.Name(),
+		Mode:       info.Mode(),
+		Size:       info.Size(),
+		ModTime:    info.ModTime().UnixNano(),
+		ChangeTime: changeTime(info),
+	}
+	if info.Mode().IsRegular() {
+		e.Dev, e.Ino, e.Nlink = fileIdentity(info)
+	}
+	return e
+}
+
+func (e dirEntry) isDir() bool {
+	return e.Mode.IsDir()
+}
+
+// indexDir is the recorded listing of a directory. ModTime and ChangeTime
+// are the directory's own; both are zero when the listing is not trusted.
+type indexDir struct {
+	ModTime    int64      `json:"mtime"`
+	ChangeTime int64      `json:"ctime,omitempty"`
+	Entries    []dirEntry `json:"entries"`
+}
+
+type indexFile struct {
+	LastFull time.Time           `json:"last_full"`
+	Dirs     map[string]indexDir `json:"dirs"`
+}
+
+// Index remembers the listing of every directory from the previous walk
+// of a tree. A walker given an index only lists directories whose
+// modification or change time differs from the recorded one, and takes
+// the entries of the others from the index.
+//
+// Adding, removing or renaming an entry changes its directory, but
+// rewriting a file in place does not, so such edits are only seen by the
+// next full rescan. Every walk is a full one when the last was more than
+// the rescan interval ago.
+//
+// An Index is used by one walker and is not safe for concurrent use.
+type Index struct {
+	path   string
+	rescan time.Duration
+	loaded bool
+	now    func() time.Time
+
+	lastFull time.Time
+	dirs     map[string]indexDir
+
+	// State of the walk in progress
+	started time.Time
+	full    bool
+	next    map[string]indexDir
+}
+
+// NewIndex creates an index persisted at path, which forces a full walk
+// every rescan (0 selects DefaultFullRescan). An empty path keeps the
+// index in memory only.
+func NewIndex(path string, rescan time.Duration) *Index {
+	if rescan <= 0 {
+		rescan = DefaultFullRescan
+	}
+	return &Index{
+		path:   path,
+		rescan: rescan,
+		now:    time.Now,
+		dirs:   make(map[string]indexDir),
+	}
+}
+
+// Load reads the index from disk the first time it is called. A missing
+// file leaves the index empty, which makes the next walk a full one.
+func (x *Index) Load() error {
+	if x.loaded || x.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(x.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			x.loaded = true
+			return nil
+		}
+		return fmt.Errorf("read scan index: %w", err)
+	}
+
+	var file indexFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("parse scan index: %w", err)
+	}
+	if file.Dirs == nil {
+		file.Dirs = make(map[string]indexDir)
+	}
+
+	x.lastFull, x.dirs = file.LastFull, file.Dirs
+	x.loaded = true
+
+	return nil
+}
+
+// Save writes the index recorded by the last complete walk to disk.
+func (x *Index) Save() error {
+	if x.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(indexFile{LastFull: x.lastFull, Dirs: x.dirs})
+	if err != nil {
+		return fmt.Errorf("marshal scan index: %w", err)
+	}
+
+	if err := WriteStateFile(x.path, data); err != nil {
+		return fmt.Errorf("write scan index: %w", err)
+	}
+
+	return nil
+}
+
+// begin starts recording a walk, which is a full one when the last full
+// walk is older than the rescan interval.
+func (x *Index) begin() {
+	x.started = x.now()
+	x.full = x.lastFull.IsZero() || x.started.Sub(x.lastFull) >= x.rescan
+	x.next = make(map[string]indexDir)
+}
+
+// end replaces the index with the listings recorded by the walk, unless
+// it failed and may have left directories out.
+func (x *Index) end(ok bool) {
+	if ok {
+		x.dirs = x.next
+		if x.full {
+			x.lastFull = x.started
+		}
+	}
+	x.next = nil
+}
+
+// lookup returns the recorded entries of dir (slash-separated, "." for the
+// root) if self, the directory's current entry, shows it has not changed.
+func (x *Index) lookup(dir string, self dirEntry) ([]dirEntry, bool) {
+	if x.full {
+		return nil, false
+	}
+	rec, ok := x.dirs[dir]
+	if !ok || rec.ModTime == 0 || rec.ModTime != self.ModTime || rec.ChangeTime != self.ChangeTime {
+		return nil, false
+	}
+	return rec.Entries, true
+}
+
+// record notes the entries of dir as listed by the walk in progress. A
+// directory changed just before the walk started is recorded as untrusted.
+func (x *Index) record(dir string, self dirEntry, entries []dirEntry) {
+	rec := indexDir{Entries: entries}
+	settled := x.started.Add(-racyWindow).UnixNano()
+	if self.ModTime < settled && self.ChangeTime < settled {
+		rec.ModTime, rec.ChangeTime = self.ModTime, self.ChangeTime
+	}
+	x.next[dir] = rec
+}
@@ -0,0 +1,19 @@
+//go:build linux
+
+package fs
+
+import (
+	"os"
+	"syscall"
+)
+
+// changeTime returns the inode change time in nanoseconds. Unlike the
+// modification time it cannot be set back, so a directory restored to its
+// old mtime after being written to still shows the change.
+func changeTime(info os.FileInfo) int64 {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return st.Ctim.Nano()
+}
@@ -0,0 +1,115 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func walkSizes(t *testing.T, w *LocalWalker) map[string]int64 {
+	t.Helper()
+	sizes := make(map[string]int64)
+	if err := w.Walk(func(info FileInfo) error {
+		sizes[filepath.ToSlash(info.Path)] = info.Size
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return sizes
+}
+
+func TestIndexedWalk(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"top.txt", "a/one.txt", "a/b/two.txt"} {
+		if err := os.WriteFile(filepath.Join(root, filepath.FromSlash(name)), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Walks run a minute ahead, so the fresh directories count as settled
+	clock := time.Now().Add(time.Minute)
+	index := NewIndex(filepath.Join(t.TempDir(), "index.json"), time.Hour)
+	index.now = func() time.Time { return clock }
+	w := NewLocalWalker(root)
+	w.SetIndex(index)
+
+	if got := walkSizes(t, w); len(got) != 5 {
+		t.Fatalf("first walk reported %v", got)
+	}
+	if err := index.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewriting a file in place leaves its directory unchanged, while a
+	// new file changes its own directory but none of the others
+	if err := os.WriteFile(filepath.Join(root, "a", "one.txt"), []byte("longer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a", "b", "three.txt"), []byte("xyz"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reloaded index behaves the same as the one in memory
+	reloaded := NewIndex(index.path, time.Hour)
+	if err := reloaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	clock = clock.Add(time.Minute)
+	reloaded.now = func() time.Time { return clock }
+	w.SetIndex(reloaded)
+
+	got := walkSizes(t, w)
+	if got["a/b/three.txt"] != 3 {
+		t.Errorf("new file in a changed directory not reported: %v", got)
+	}
+	if got["a/one.txt"] != 1 {
+		t.Errorf("unchanged directory was listed again: a/one.txt has size %d", got["a/one.txt"])
+	}
+
+	// The full rescan lists everything again
+	clock = clock.Add(2 * time.Hour)
+	if got := walkSizes(t, w); got["a/one.txt"] != 6 {
+		t.Errorf("full rescan reported a/one.txt with size %d, want 6", got["a/one.txt"])
+	}
+}
+
+func TestIndexedWalkRemovedDir(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := time.Now().Add(time.Minute)
+	index := NewIndex("", time.Hour)
+	index.now = func() time.Time { return clock }
+	w := NewLocalWalker(root)
+	w.SetIndex(index)
+	walkSizes(t, w)
+
+	if err := os.Remove(filepath.Join(root, "a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if got := walkSizes(t, w); len(got) != 1 {
+		t.Errorf("got %v, want only a", got)
+	}
+}
+
+func TestIndexRecentChangesUntrusted(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	index := NewIndex("", time.Hour)
+	w := NewLocalWalker(root)
+	w.SetIndex(index)
+	walkSizes(t, w)
+
+	if rec := index.dirs["."]; rec.ModTime != 0 {
+		t.Errorf("directory changed during the racy window recorded as trusted")
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+
+package fs
+
+import "os"
+
+// fileIdentity reports no identity where it is not available, so hard
+// links are copied as separate files.
+func fileIdentity(info os.FileInfo) (dev, ino, nlink uint64) {
+	return 0, 0, 0
+}
+
+// allocatedSize assumes every byte is allocated where block counts are not
+// available, so no file is treated as sparse.
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
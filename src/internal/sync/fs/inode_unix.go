@@ -0,0 +1,26 @@
+//go:build linux || darwin
+
+package fs
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileIdentity returns the device, inode and link count of a file.
+func fileIdentity(info os.FileInfo) (dev, ino, nlink uint64) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, 0
+	}
+	return uint64(st.Dev), uint64(st.Ino), uint64(st.Nlink)
+}
+
+// allocatedSize returns the disk space allocated to a file.
+func allocatedSize(info os.FileInfo) int64 {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.Size()
+	}
+	return int64(st.Blocks) * 512
+}
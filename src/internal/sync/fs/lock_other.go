@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package fs
+
+import "os"
+
+// lockFile does nothing where advisory locks are not available.
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,47 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+)
+
+// MetadataOptions selects the metadata copied in addition to permissions
+// and file modification times.
+type MetadataOptions struct {
+	Xattrs    bool // extended attributes such as Finder tags and SELinux labels
+	ACLs      bool // POSIX ACLs (Linux, where they are stored as attributes)
+	Ownership bool // uid and gid, applied only when running as root
+	DirTimes  bool // directory modification times
+}
+
+// SetMetadata selects the extra metadata c copies onto every file.
+func (c *LocalCopier) SetMetadata(opts MetadataOptions) {
+	c.metadata = opts
+}
+
+// CopyDirMetadata gives the directory dst the permissions and selected
+// metadata of src. It must run after the directory's contents have been
+// written, since adding or removing entries changes its modification time.
+// The owner keeps full access so later runs can still write into dst.
+func CopyDirMetadata(src, dst string, opts MetadataOptions) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("stat source directory: %w", err)
+	}
+
+	if err := copyExtendedMetadata(src, dst, info, opts); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(dst, info.Mode().Perm()|0700); err != nil {
+		return fmt.Errorf("set directory permissions: %w", err)
+	}
+
+	if opts.DirTimes {
+		if err := os.Chtimes(dst, info.ModTime(), info.ModTime()); err != nil {
+			return fmt.Errorf("set directory times: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package fs
+
+import "os"
+
+// copyExtendedMetadata is a no-op where extended attributes, POSIX ACLs
+// and numeric ownership are not available.
+func copyExtendedMetadata(src, dst string, info os.FileInfo, opts MetadataOptions) error {
+	return nil
+}
@@ -0,0 +1,131 @@
+//go:build linux || darwin
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyExtendedMetadata copies the extended attributes, ACLs and ownership
+// selected by opts from src to dst. Attributes the destination filesystem
+// does not support, or that need privileges we lack, are skipped.
+func copyExtendedMetadata(src, dst string, info os.FileInfo, opts MetadataOptions) error {
+	if opts.Ownership && os.Geteuid() == 0 {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			if err := os.Chown(dst, int(st.Uid), int(st.Gid)); err != nil {
+				return fmt.Errorf("set ownership: %w", err)
+			}
+		}
+	}
+
+	if !opts.Xattrs && !opts.ACLs {
+		return nil
+	}
+
+	names, err := listXattrs(src)
+	if err != nil {
+		if skippableXattrErr(err) {
+			return nil
+		}
+		return fmt.Errorf("list attributes: %w", err)
+	}
+
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !wantXattr(name, opts) {
+			continue
+		}
+		keep[name] = true
+
+		value, err := getXattr(src, name)
+		if err != nil {
+			if skippableXattrErr(err) || errors.Is(err, unix.ENODATA) {
+				continue
+			}
+			return fmt.Errorf("read attribute %s: %w", name, err)
+		}
+		if err := unix.Setxattr(dst, name, value, 0); err != nil {
+			if skippableXattrErr(err) {
+				continue
+			}
+			return fmt.Errorf("set attribute %s: %w", name, err)
+		}
+	}
+
+	// Drop attributes the source no longer has.
+	existing, err := listXattrs(dst)
+	if err != nil {
+		return nil
+	}
+	for _, name := range existing {
+		if wantXattr(name, opts) && !keep[name] {
+			unix.Removexattr(dst, name)
+		}
+	}
+
+	return nil
+}
+
+// wantXattr reports whether opts selects the attribute.
+func wantXattr(name string, opts MetadataOptions) bool {
+	if name == "system.posix_acl_access" || name == "system.posix_acl_default" {
+		return opts.ACLs
+	}
+	return opts.Xattrs
+}
+
+// skippableXattrErr reports errors that mean an attribute cannot be copied
+// here rather than that the copy went wrong.
+func skippableXattrErr(err error) bool {
+	return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) ||
+		errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES)
+}
+
+func listXattrs(path string) ([]string, error) {
+	for {
+		size, err := unix.Listxattr(path, nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		size, err = unix.Listxattr(path, buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue // grew in between
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var names []string
+		for _, name := range strings.Split(string(buf[:size]), "\x00") {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	for {
+		size, err := unix.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		size, err = unix.Getxattr(path, name, buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	}
+}
@@ -0,0 +1,73 @@
+package fs
+
+import (
+	"fmt"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Normalization selects the Unicode form of the names written to a
+// destination. Accented letters can be stored precomposed (NFC, as most
+// Linux and Windows software does) or decomposed (NFD, as macOS HFS+ and
+// some NAS shares do), and a name in one form does not equal the same
+// name in the other byte for byte.
+type Normalization int
+
+const (
+	NormalizeNone Normalization = iota // compare and write names as they are
+	NormalizeNFC                       // match names in either form, write NFC
+	NormalizeNFD                       // match names in either form, write NFD
+)
+
+// ParseNormalization converts a config value into a Normalization.
+// The empty string selects NormalizeNone.
+func ParseNormalization(s string) (Normalization, error) {
+	switch s {
+	case "", "none":
+		return NormalizeNone, nil
+	case "nfc":
+		return NormalizeNFC, nil
+	case "nfd":
+		return NormalizeNFD, nil
+	default:
+		return NormalizeNone, fmt.Errorf("unknown unicode normalization: %q", s)
+	}
+}
+
+func (n Normalization) String() string {
+	switch n {
+	case NormalizeNFC:
+		return "nfc"
+	case NormalizeNFD:
+		return "nfd"
+	default:
+		return "none"
+	}
+}
+
+// Apply returns path in the form selected by n.
+func (n Normalization) Apply(path string) string {
+	switch n {
+	case NormalizeNFC:
+		return norm.NFC.String(path)
+	case NormalizeNFD:
+		return norm.NFD.String(path)
+	default:
+		return path
+	}
+}
+
+// NameKey returns the key two paths share when a destination stores them
+// under the same name: when names are normalized, both Unicode forms of a
+// name share one, and when foldCase is set, names that only differ in
+// letter case do too.
+func NameKey(path string, n Normalization, foldCase bool) string {
+	if n != NormalizeNone {
+		path = norm.NFC.String(path)
+	}
+	if foldCase {
+		path = cases.Fold().String(path)
+	}
+	return path
+}
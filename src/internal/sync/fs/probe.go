@@ -0,0 +1,173 @@
+package fs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Capabilities describes what a filesystem can store, as found by
+// ProbeCapabilities.
+type Capabilities struct {
+	// ModTimeGranularity is the precision of stored modification times,
+	// such as 2s on FAT, 10ms on exFAT and 100ns on NTFS.
+	ModTimeGranularity time.Duration `json:"mtime_granularity"`
+
+	// CaseSensitive is false when names differing only in letter case
+	// refer to the same entry.
+	CaseSensitive bool `json:"case_sensitive"`
+
+	Symlinks bool `json:"symlinks"`
+	Xattrs   bool `json:"xattrs"`
+
+	// MaxNameLength is the longest name that can be created, in bytes, up
+	// to the usual limit of MaxNameLength.
+	MaxNameLength int `json:"max_name_length"`
+}
+
+// probeGranularities are the timestamp precisions of common filesystems,
+// finest first.
+var probeGranularities = []time.Duration{
+	time.Nanosecond,
+	100 * time.Nanosecond,
+	time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+}
+
+// ProbeCapabilities finds what the filesystem holding dir can store by
+// writing to a temporary directory inside it, which is removed again.
+func ProbeCapabilities(dir string) (Capabilities, error) {
+	var caps Capabilities
+
+	probe, err := os.MkdirTemp(dir, ".mirrorbox-probe-*")
+	if err != nil {
+		return caps, fmt.Errorf("create probe directory: %w", err)
+	}
+	defer os.RemoveAll(probe)
+
+	file := filepath.Join(probe, "probe")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		return caps, fmt.Errorf("create probe file: %w", err)
+	}
+
+	if caps.ModTimeGranularity, err = probeModTime(file); err != nil {
+		return caps, err
+	}
+
+	_, err = os.Stat(filepath.Join(probe, "PROBE"))
+	switch {
+	case err == nil:
+	case os.IsNotExist(err):
+		caps.CaseSensitive = true
+	default:
+		return caps, fmt.Errorf("probe case sensitivity: %w", err)
+	}
+
+	caps.Symlinks = os.Symlink("probe", filepath.Join(probe, "link")) == nil
+	caps.Xattrs = probeXattrs(file)
+
+	if caps.MaxNameLength, err = probeNameLength(probe); err != nil {
+		return caps, err
+	}
+
+	return caps, nil
+}
+
+// probeModTime sets the modification time of file to values that only the
+// finest precisions keep, and returns the precision the times come back
+// with.
+func probeModTime(file string) (time.Duration, error) {
+	granularity := time.Nanosecond
+	for _, t := range []time.Time{time.Unix(1700000001, 123456789), time.Unix(1700000003, 0)} {
+		if err := os.Chtimes(file, t, t); err != nil {
+			return 0, fmt.Errorf("probe modification time: %w", err)
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return 0, fmt.Errorf("probe modification time: %w", err)
+		}
+
+		diff := info.ModTime().Sub(t)
+		if diff < 0 {
+			diff = -diff
+		}
+		found := diff.Truncate(time.Second) + time.Second
+		for _, g := range probeGranularities {
+			if diff < g {
+				found = g
+				break
+			}
+		}
+		granularity = max(granularity, found)
+	}
+	return granularity, nil
+}
+
+// probeNameLength returns the longest name, up to MaxNameLength bytes,
+// that can be created in dir.
+func probeNameLength(dir string) (int, error) {
+	fits := func(n int) (bool, error) {
+		path := filepath.Join(dir, strings.Repeat("n", n))
+		f, err := os.Create(path)
+		if errors.Is(err, syscall.ENAMETOOLONG) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("probe name length: %w", err)
+		}
+		f.Close()
+		return true, os.Remove(path)
+	}
+
+	// lo fits and hi does not
+	lo, hi := 1, MaxNameLength+1
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if mid == lo+1 && hi == MaxNameLength+1 {
+			mid = MaxNameLength // try the usual limit first
+		}
+		ok, err := fits(mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// LoadCapabilities reads a profile saved by SaveCapabilities.
+func LoadCapabilities(path string) (Capabilities, error) {
+	var caps Capabilities
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return caps, fmt.Errorf("read capabilities: %w", err)
+	}
+	if err := json.Unmarshal(data, &caps); err != nil {
+		return caps, fmt.Errorf("parse capabilities: %w", err)
+	}
+	return caps, nil
+}
+
+// SaveCapabilities writes caps to path.
+func SaveCapabilities(path string, caps Capabilities) error {
+	data, err := json.Marshal(caps)
+	if err != nil {
+		return fmt.Errorf("marshal capabilities: %w", err)
+	}
+	if err := WriteStateFile(path, data); err != nil {
+		return fmt.Errorf("write capabilities: %w", err)
+	}
+	return nil
+}
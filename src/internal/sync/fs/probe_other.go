@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package fs
+
+// probeXattrs reports false where extended attributes are not copied.
+func probeXattrs(file string) bool {
+	return false
+}
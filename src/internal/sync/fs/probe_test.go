@@ -0,0 +1,43 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProbeCapabilities(t *testing.T) {
+	dir := t.TempDir()
+
+	caps, err := ProbeCapabilities(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.ModTimeGranularity <= 0 || caps.ModTimeGranularity > 2*time.Second {
+		t.Errorf("modification time granularity %v", caps.ModTimeGranularity)
+	}
+	if caps.MaxNameLength < 1 || caps.MaxNameLength > MaxNameLength {
+		t.Errorf("maximum name length %d", caps.MaxNameLength)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("probe left %d entries behind", len(entries))
+	}
+
+	path := filepath.Join(t.TempDir(), "capabilities.json")
+	if err := SaveCapabilities(path, caps); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadCapabilities(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != caps {
+		t.Errorf("loaded %+v, saved %+v", loaded, caps)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build linux || darwin
+
+package fs
+
+import "golang.org/x/sys/unix"
+
+// probeXattrs reports whether user extended attributes can be set on file.
+func probeXattrs(file string) bool {
+	return unix.Setxattr(file, "user.mirrorbox.probe", []byte("1"), 0) == nil
+}
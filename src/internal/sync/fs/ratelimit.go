@@ -0,0 +1,145 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// throttleChunk bounds each throttled read, so concurrent transfers share
+// the bandwidth in small slices.
+const throttleChunk = 32 * 1024
+
+// RateWindow overrides the limit between two times of day. A window whose
+// End is before its Start wraps around midnight. A zero Limit is unlimited.
+type RateWindow struct {
+	Start time.Duration // since midnight
+	End   time.Duration // since midnight
+	Limit int64         // bytes per second
+}
+
+// ParseTimeOfDay parses "HH:MM" into the time since midnight.
+func ParseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w RateWindow) contains(t time.Time) bool {
+	tod := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+	if w.Start <= w.End {
+		return tod >= w.Start && tod < w.End
+	}
+	return tod >= w.Start || tod < w.End
+}
+
+// RateLimiter is a token bucket shared by any number of concurrent
+// transfers. A rate of 0 is unlimited.
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    int64
+	windows []RateWindow
+	tokens  float64
+	last    time.Time
+}
+
+// NewRateLimiter creates a limiter allowing rate bytes per second.
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{rate: rate}
+}
+
+// SetRate changes the limit while transfers may be running. The first
+// window containing the current time of day takes precedence over rate.
+func (l *RateLimiter) SetRate(rate int64, windows []RateWindow) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.windows = windows
+}
+
+func (l *RateLimiter) currentRate(now time.Time) int64 {
+	for _, w := range l.windows {
+		if w.contains(now) {
+			return w.Limit
+		}
+	}
+	return l.rate
+}
+
+// Wait blocks until n more bytes may be transferred. Transfers may run up
+// to one second's worth of data ahead before they are held back.
+func (l *RateLimiter) Wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	rate := l.currentRate(now)
+	if rate <= 0 {
+		l.tokens = 0
+		l.last = now
+		l.mu.Unlock()
+		return nil
+	}
+
+	burst := float64(rate)
+	l.tokens = math.Min(burst, l.tokens+now.Sub(l.last).Seconds()*float64(rate))
+	l.last = now
+	l.tokens -= float64(n)
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// cancelReader fails reads once ctx is cancelled, so an unthrottled copy
+// still stops with its job.
+type cancelReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *cancelReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// throttledReader holds reads back to the limiter's rate.
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *RateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.limiter.Wait(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
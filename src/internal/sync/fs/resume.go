@@ -0,0 +1,236 @@
+package fs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	partialPrefix      = ".mirrorbox-partial-"
+	resumeChunk        = 1024 * 1024      // bytes copied between cancellation checks
+	checkpointInterval = 32 * 1024 * 1024 // bytes copied between checkpoints
+)
+
+// ErrLocked is returned when another copy is already writing the same
+// partial file, for example an overlapping run of the same folder.
+var ErrLocked = errors.New("partial file is in use by another copy")
+
+// ResumableCopier is implemented by copiers that can continue an
+// interrupted copy where it stopped instead of starting over.
+type ResumableCopier interface {
+	// CopyResumable copies srcPath to dstPath through a partial file kept
+	// next to dstPath. If ctx is cancelled the partial file and its
+	// checkpoint are left behind, and the next call for the same source
+	// continues from the last verified offset.
+	CopyResumable(ctx context.Context, srcPath, dstPath string) (CopyStats, error)
+}
+
+// checkpoint records how far a partial copy got and what it was copying.
+type checkpoint struct {
+	Size       int64  `json:"size"`        // source size
+	ModTime    int64  `json:"mtime"`       // source mtime, ns
+	Offset     int64  `json:"offset"`      // bytes safely written
+	PrefixHash string `json:"prefix_hash"` // sha256 of the first Offset bytes
+}
+
+// PartialPaths returns the partial file and checkpoint used while copying
+// to dstPath. Both carry the internal prefix, so walkers never report them.
+func PartialPaths(dstPath string) (partial, checkpointPath string) {
+	partial = filepath.Join(filepath.Dir(dstPath), partialPrefix+filepath.Base(dstPath))
+	return partial, partial + ".json"
+}
+
+// IsPartial reports whether name is a partial file or checkpoint written
+// by CopyResumable.
+func IsPartial(name string) bool {
+	return strings.HasPrefix(name, partialPrefix)
+}
+
+// RemovePartial deletes a partial file or checkpoint that no copy is going
+// to resume. A partial file locked by a copy in progress is left alone.
+func RemovePartial(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	if err := lockFile(f); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// CopyResumable copies srcPath to dstPath, resuming an earlier interrupted
+// copy of the same source version when one is found.
+func (c *LocalCopier) CopyResumable(ctx context.Context, srcPath, dstPath string) (CopyStats, error) {
+	stats := CopyStats{Method: CopyBuffered}
+
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return stats, fmt.Errorf("open source file: %w", err)
+	}
+	defer srcFile.Close()
+
+	srcInfo, err := srcFile.Stat()
+	if err != nil {
+		return stats, fmt.Errorf("stat source file: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return stats, fmt.Errorf("create parent directories: %w", err)
+	}
+
+	partialPath, cpPath := PartialPaths(dstPath)
+	cp := checkpoint{Size: srcInfo.Size(), ModTime: srcInfo.ModTime().UnixNano()}
+
+	partial, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return stats, fmt.Errorf("open partial file: %w", err)
+	}
+	defer partial.Close()
+
+	// The checkpoint is only checked here, so a second writer would go
+	// unnoticed until the next resume.
+	if err := lockFile(partial); err != nil {
+		return stats, fmt.Errorf("lock partial file: %w", err)
+	}
+
+	h := sha256.New()
+	cp.Offset = resumeOffset(partial, cpPath, cp, h)
+
+	if err := partial.Truncate(cp.Offset); err != nil {
+		return stats, fmt.Errorf("truncate partial file: %w", err)
+	}
+	if _, err := partial.Seek(cp.Offset, io.SeekStart); err != nil {
+		return stats, fmt.Errorf("seek partial file: %w", err)
+	}
+	if _, err := srcFile.Seek(cp.Offset, io.SeekStart); err != nil {
+		return stats, fmt.Errorf("seek source file: %w", err)
+	}
+
+	// Zero blocks of a sparse source are skipped, leaving holes. The file
+	// is truncated to the copied offset whenever it must be complete.
+	var out io.Writer = partial
+	if isSparse(srcInfo) {
+		out = &sparseWriter{f: partial}
+	}
+
+	src := c.throttle(ctx, srcFile)
+	buf := make([]byte, resumeChunk)
+	lastCheckpoint := cp.Offset
+	for {
+		if err := ctx.Err(); err != nil {
+			saveCheckpoint(partial, cpPath, cp, h)
+			return stats, err
+		}
+
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			if _, err := out.Write(buf[:n]); err != nil {
+				saveCheckpoint(partial, cpPath, cp, h)
+				return stats, fmt.Errorf("write partial file: %w", err)
+			}
+			h.Write(buf[:n])
+			cp.Offset += int64(n)
+			stats.BytesWritten += int64(n)
+
+			if cp.Offset-lastCheckpoint >= checkpointInterval {
+				saveCheckpoint(partial, cpPath, cp, h)
+				lastCheckpoint = cp.Offset
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			saveCheckpoint(partial, cpPath, cp, h)
+			return stats, fmt.Errorf("read source file: %w", readErr)
+		}
+	}
+
+	if err := partial.Truncate(cp.Offset); err != nil {
+		return stats, fmt.Errorf("truncate partial file: %w", err)
+	}
+
+	// h covers the whole source: the verified prefix plus this run's data.
+	if c.verify {
+		if err := verifyWritten(partial, h); err != nil {
+			partial.Close()
+			os.Remove(partialPath)
+			os.Remove(cpPath)
+			return stats, err
+		}
+	}
+
+	if err := c.applyMetadata(srcPath, partialPath, srcInfo); err != nil {
+		return stats, err
+	}
+	stats.BytesAllocated = allocated(partial)
+	if err := replace(partial, dstPath, c.fsync); err != nil {
+		return stats, err
+	}
+	os.Remove(cpPath)
+
+	return stats, nil
+}
+
+// resumeOffset returns the offset a copy can safely continue from, feeding
+// the verified prefix of partial into h. It returns 0 when there is no
+// checkpoint, the source changed since it was written, or the partial
+// file no longer matches it.
+func resumeOffset(partial *os.File, cpPath string, want checkpoint, h hash.Hash) int64 {
+	data, err := os.ReadFile(cpPath)
+	if err != nil {
+		return 0
+	}
+
+	var saved checkpoint
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return 0
+	}
+	if saved.Size != want.Size || saved.ModTime != want.ModTime || saved.Offset <= 0 || saved.Offset > want.Size {
+		return 0
+	}
+
+	if _, err := io.Copy(h, io.LimitReader(partial, saved.Offset)); err != nil {
+		h.Reset()
+		return 0
+	}
+	if hex.EncodeToString(h.Sum(nil)) != saved.PrefixHash {
+		h.Reset()
+		return 0
+	}
+
+	return saved.Offset
+}
+
+// saveCheckpoint flushes the partial file and records the current offset.
+// Failures only cost the ability to resume, so they are not reported.
+func saveCheckpoint(partial *os.File, cpPath string, cp checkpoint, h hash.Hash) {
+	if err := partial.Truncate(cp.Offset); err != nil {
+		return
+	}
+	if err := partial.Sync(); err != nil {
+		return
+	}
+
+	cp.PrefixHash = hex.EncodeToString(h.Sum(nil))
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return
+	}
+	WriteStateFile(cpPath, data)
+}
@@ -0,0 +1,45 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCopyResumableLocked(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("partial files are only locked on Unix")
+	}
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	if err := os.WriteFile(src, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	partialPath, _ := PartialPaths(dst)
+	held, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lockFile(held); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewLocalCopier(true)
+	if _, err := c.CopyResumable(context.Background(), src, dst); !errors.Is(err, ErrLocked) {
+		t.Fatalf("got %v, want ErrLocked", err)
+	}
+
+	held.Close()
+	if _, err := c.CopyResumable(context.Background(), src, dst); err != nil {
+		t.Fatalf("copy after the lock was released: %v", err)
+	}
+	if data, _ := os.ReadFile(dst); string(data) != "contents" {
+		t.Fatalf("got %q", data)
+	}
+}
@@ -0,0 +1,99 @@
+package fs
+
+import (
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// MaxNameLength is the longest name, in UTF-16 code units, that exFAT,
+// FAT32 with long names and NTFS can store.
+const MaxNameLength = 255
+
+// NameError reports a name that cannot be stored at the destination, even
+// once sanitized.
+type NameError struct {
+	Name   string
+	Reason string
+}
+
+func (e *NameError) Error() string {
+	return "cannot store " + e.Name + " at the destination: " + e.Reason
+}
+
+// sanitizedChars maps the characters Windows, exFAT and FAT32 do not allow
+// in names to the private use characters Samba and macOS store them as on
+// SMB shares, so they display the same there.
+var sanitizedChars = map[rune]rune{
+	'"':  '\uF020',
+	'*':  '\uF021',
+	':':  '\uF022',
+	'<':  '\uF023',
+	'>':  '\uF024',
+	'?':  '\uF025',
+	'\\': '\uF026',
+	'|':  '\uF027',
+}
+
+const (
+	sanitizedSpace  = '\uF028' // trailing space
+	sanitizedPeriod = '\uF029' // trailing period
+)
+
+// reservedNames are the device names Windows will not create a file
+// under, with or without an extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeName returns name in a form Windows, exFAT and FAT32 can store.
+// Forbidden characters, control characters, and a trailing space or period
+// are replaced by private use characters (U+F001 to U+F029), and the last
+// letter of a reserved device name such as CON is moved to U+F000 plus its
+// code. A name already using those characters is left as it is, so two
+// names can share a sanitized form. Names that are not valid UTF-8 or are
+// too long once encoded return a *NameError.
+func SanitizeName(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", &NameError{Name: name, Reason: "not valid UTF-8"}
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		switch mapped, ok := sanitizedChars[r]; {
+		case ok:
+			b.WriteRune(mapped)
+		case r > 0 && r < 0x20:
+			b.WriteRune(0xF000 + r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	sanitized := b.String()
+
+	switch {
+	case strings.HasSuffix(sanitized, " "):
+		sanitized = sanitized[:len(sanitized)-1] + string(sanitizedSpace)
+	case strings.HasSuffix(sanitized, "."):
+		sanitized = sanitized[:len(sanitized)-1] + string(sanitizedPeriod)
+	}
+
+	stem, ext, hasExt := strings.Cut(sanitized, ".")
+	if reservedNames[strings.ToUpper(stem)] {
+		last := rune(stem[len(stem)-1])
+		sanitized = stem[:len(stem)-1] + string(0xF000+last)
+		if hasExt {
+			sanitized += "." + ext
+		}
+	}
+
+	if n := len(utf16.Encode([]rune(sanitized))); n > MaxNameLength {
+		return "", &NameError{Name: name, Reason: "name too long"}
+	}
+
+	return sanitized, nil
+}
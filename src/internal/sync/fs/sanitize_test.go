@@ -0,0 +1,44 @@
+package fs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string // empty for a *NameError
+	}{
+		{"plain.txt", "plain.txt"},
+		{"a:b?.txt", "a\uF022b\uF025.txt"},
+		{`<"*\|>`, "\uF023\uF020\uF021\uF026\uF027\uF024"},
+		{"tab\there", "tab\uF009here"},
+		{"trailing.", "trailing\uF029"},
+		{"trailing ", "trailing\uF028"},
+		{"inner. dots.txt", "inner. dots.txt"},
+		{"CON", "CO\uF04E"},
+		{"con.txt", "co\uF06E.txt"},
+		{"LPT1.tar.gz", "LPT\uF031.tar.gz"},
+		{"CONSOLE", "CONSOLE"},
+		{"été", "été"},
+		{"bad\xff", ""},
+		{strings.Repeat("x", MaxNameLength), strings.Repeat("x", MaxNameLength)},
+		{strings.Repeat("x", MaxNameLength+1), ""},
+	}
+
+	for _, tt := range tests {
+		got, err := SanitizeName(tt.name)
+		if tt.want == "" {
+			var nameErr *NameError
+			if !errors.As(err, &nameErr) {
+				t.Errorf("SanitizeName(%q) = %q, %v, want a name error", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("SanitizeName(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package fs
+
+import (
+	"io"
+	"os"
+)
+
+// isSparse reports whether info describes a regular file with less disk
+// space allocated than its size, i.e. one with holes worth preserving.
+func isSparse(info os.FileInfo) bool {
+	return info.Mode().IsRegular() && allocatedSize(info) < info.Size()
+}
+
+// allocated returns the disk space taken by f, or 0 if it cannot be read.
+func allocated(f *os.File) int64 {
+	info, err := f.Stat()
+	if err != nil {
+		return 0
+	}
+	return allocatedSize(info)
+}
+
+// copyZeroSkipping copies r into dst, leaving holes wherever a whole buffer
+// of zeros was read, and extends dst to size. It is used where the
+// filesystem cannot report the source's holes.
+func copyZeroSkipping(dst *os.File, r io.Reader, size int64) (int64, error) {
+	n, err := io.Copy(&sparseWriter{f: dst}, r)
+	if err != nil {
+		return n, err
+	}
+	return n, dst.Truncate(size)
+}
+
+// sparseWriter seeks over blocks of zeros instead of writing them, so they
+// become holes. A trailing hole only exists once the file is truncated to
+// its full size.
+type sparseWriter struct {
+	f *os.File
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	if !allZero(p) {
+		return w.f.Write(p)
+	}
+	if _, err := w.f.Seek(int64(len(p)), io.SeekCurrent); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func allZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
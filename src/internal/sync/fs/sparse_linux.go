@@ -0,0 +1,55 @@
+//go:build linux
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copySparse copies only the data extents of src, found with SEEK_DATA and
+// SEEK_HOLE, and leaves the holes between them unallocated in dst. Data is
+// read through r, which must read from src's current offset. It returns
+// the number of data bytes copied.
+func copySparse(dst, src *os.File, r io.Reader, size int64) (int64, error) {
+	var written int64
+
+	for off := int64(0); off < size; {
+		data, err := src.Seek(off, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			break // nothing but a hole up to the end
+		}
+		if err != nil {
+			if off == 0 {
+				// The filesystem does not report holes
+				return copyZeroSkipping(dst, r, size)
+			}
+			return written, fmt.Errorf("find data: %w", err)
+		}
+
+		hole, err := src.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return written, fmt.Errorf("find hole: %w", err)
+		}
+
+		if _, err := src.Seek(data, io.SeekStart); err != nil {
+			return written, err
+		}
+		if _, err := dst.Seek(data, io.SeekStart); err != nil {
+			return written, err
+		}
+
+		n, err := io.CopyN(dst, r, hole-data)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		off = hole
+	}
+
+	return written, dst.Truncate(size)
+}
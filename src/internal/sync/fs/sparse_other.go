@@ -0,0 +1,14 @@
+//go:build !linux
+
+package fs
+
+import (
+	"io"
+	"os"
+)
+
+// copySparse recreates holes by skipping blocks of zeros, as holes cannot
+// be located directly here. It returns the number of bytes read from r.
+func copySparse(dst, src *os.File, r io.Reader, size int64) (int64, error) {
+	return copyZeroSkipping(dst, r, size)
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package fs
+
+// syncDir does nothing where directories cannot be flushed on their own.
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin
+
+package fs
+
+import "os"
+
+// syncDir flushes the entries of dir to disk, making renames into it
+// durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,74 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// VerifyError reports a copy whose written contents do not match the
+// source data that was streamed into it.
+type VerifyError struct {
+	Path string // the file that was read back
+	Want string // sha256 of the source stream
+	Got  string // sha256 of the written file
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("verification failed for %s: source %.12s, written %.12s", e.Path, e.Want, e.Got)
+}
+
+// SetVerify makes c read every written file back and compare it with a
+// digest of the source taken while copying.
+func (c *LocalCopier) SetVerify(verify bool) {
+	c.verify = verify
+}
+
+// tee returns r unchanged and a nil hash when verification is off, and
+// otherwise a reader that feeds everything read into the returned hash.
+func (c *LocalCopier) tee(r io.Reader) (io.Reader, hash.Hash) {
+	if !c.verify {
+		return r, nil
+	}
+	h := sha256.New()
+	return io.TeeReader(r, h), h
+}
+
+// hashFrom returns a hash fed with the whole of f, for sources that were
+// not read in full while copying.
+func hashFrom(f *os.File) (hash.Hash, error) {
+	h := sha256.New()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// verifyWritten flushes f to disk and compares its contents with the
+// digest in h. It is a no-op when h is nil.
+func verifyWritten(f *os.File, h hash.Hash) error {
+	if h == nil {
+		return nil
+	}
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("flush for verification: %w", err)
+	}
+
+	want := hex.EncodeToString(h.Sum(nil))
+	got, err := HashFile(f.Name())
+	if err != nil {
+		return fmt.Errorf("read back for verification: %w", err)
+	}
+	if got != want {
+		return &VerifyError{Path: f.Name(), Want: want, Got: got}
+	}
+
+	return nil
+}
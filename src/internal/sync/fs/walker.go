@@ -3,8 +3,12 @@ package fs
 import (
 	"fmt"
 	"io/fs"
+	"log"
 	"os"
+	pathpkg "path"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 type FileInfo struct {
@@ -12,6 +16,60 @@ type FileInfo struct {
 	Size    int64
 	ModTime int64
 	IsDir   bool
+
+	// Digest is the hex-encoded SHA-256 of the contents, empty until computed.
+	Digest string
+
+	// IsSymlink is set when the entry is reported as a link rather than
+	// followed; LinkTarget then holds the unmodified link contents.
+	IsSymlink  bool
+	LinkTarget string
+
+	// Dev, Ino and Nlink identify hard-linked regular files. They are zero
+	// for other entries and on platforms that do not report them.
+	Dev   uint64
+	Ino   uint64
+	Nlink uint64
+}
+
+// HardLinked reports whether the file shares its contents with other paths.
+func (f FileInfo) HardLinked() bool {
+	return f.Nlink > 1 && f.Ino != 0
+}
+
+// SymlinkMode selects how a walker reports symbolic links.
+type SymlinkMode int
+
+const (
+	SymlinkPreserve SymlinkMode = iota // report the link itself
+	SymlinkFollow                      // report the target, descending into linked directories
+	SymlinkSkip                        // leave links out entirely
+)
+
+// ParseSymlinkMode converts a config value into a SymlinkMode.
+// The empty string selects SymlinkPreserve.
+func ParseSymlinkMode(s string) (SymlinkMode, error) {
+	switch s {
+	case "", "preserve":
+		return SymlinkPreserve, nil
+	case "follow":
+		return SymlinkFollow, nil
+	case "skip":
+		return SymlinkSkip, nil
+	default:
+		return SymlinkPreserve, fmt.Errorf("unknown symlink mode: %q", s)
+	}
+}
+
+func (m SymlinkMode) String() string {
+	switch m {
+	case SymlinkFollow:
+		return "follow"
+	case SymlinkSkip:
+		return "skip"
+	default:
+		return "preserve"
+	}
 }
 
 type Walker interface {
@@ -20,46 +78,424 @@ type Walker interface {
 	Walk(fn func(FileInfo) error) error
 }
 
+// LocalWalker reports entries depth first, with the entries of each
+// directory sorted by name, so paths arrive in ComparePaths order.
 type LocalWalker struct {
-	root string
+	root     string
+	ignore   *IgnoreRules
+	symlinks SymlinkMode
+
+	// index, when set, spares listing directories unchanged since the
+	// previous walk.
+	index *Index
+
+	// partials lists the partial transfer files seen by the last walk.
+	partials []string
 }
 
 func NewLocalWalker(root string) *LocalWalker {
 	return &LocalWalker{root: root}
 }
 
+// SetIgnoreRules sets the rules applied from the root. Rules found in
+// .mirrorboxignore files inside the tree are added below their directory.
+func (w *LocalWalker) SetIgnoreRules(rules *IgnoreRules) {
+	w.ignore = rules
+}
+
+// SetSymlinkMode selects how symbolic links are reported.
+func (w *LocalWalker) SetSymlinkMode(mode SymlinkMode) {
+	w.symlinks = mode
+}
+
+// SetIndex makes the walker record each walk in index and take the
+// entries of unchanged directories from it. Nil lists every directory.
+func (w *LocalWalker) SetIndex(index *Index) {
+	w.index = index
+}
+
+// Partials returns the partial transfer files the last walk came across,
+// below the walker's root. Like all internal files, they are not reported
+// to the walk function.
+func (w *LocalWalker) Partials() []string {
+	return w.partials
+}
+
+// walkState is shared by the root walk and every followed directory link.
+type walkState struct {
+	fn func(FileInfo) error
+
+	// Effective rules of the directories on the path to the current entry,
+	// root first. Each inherits from its parent and is extended by its
+	// ignore file. Paths arrive depth first, so a directory's rules are
+	// dropped as soon as the walk has left it.
+	dirRules []dirRules
+
+	// index is the walker's index while a whole-tree walk records it.
+	index *Index
+
+	// partials collects the partial transfer files seen by the walk.
+	partials []string
+}
+
+// dirRules are the effective rules of a directory (slash-separated, "."
+// for the root).
+type dirRules struct {
+	dir   string
+	rules *IgnoreRules
+}
+
+// rulesFor returns the rules of dir, which must be the current directory
+// or one of its parents, and drops those of the directories below it.
+func (s *walkState) rulesFor(dir string) *IgnoreRules {
+	for len(s.dirRules) > 1 && s.dirRules[len(s.dirRules)-1].dir != dir {
+		s.dirRules = s.dirRules[:len(s.dirRules)-1]
+	}
+	return s.dirRules[len(s.dirRules)-1].rules
+}
+
 func (w *LocalWalker) Walk(fn func(FileInfo) error) error {
-	return filepath.WalkDir(w.root, func(path string, d fs.DirEntry, err error) error {
+	w.partials = nil
+
+	rootRules := w.ignore
+	if rootRules == nil {
+		rootRules = &IgnoreRules{}
+	}
+
+	rules, err := rootRules.loadIgnoreFile(w.root, "")
+	if err != nil {
+		return err
+	}
+
+	state := &walkState{
+		fn:       fn,
+		dirRules: []dirRules{{".", rules}},
+		index:    w.index,
+	}
+
+	realRoot, err := filepath.EvalSymlinks(w.root)
+	if err != nil {
+		return fmt.Errorf("resolve root: %w", err)
+	}
+	rootInfo, err := os.Stat(realRoot)
+	if err != nil {
+		return fmt.Errorf("walk error at %s: %w", w.root, err)
+	}
+	if !rootInfo.IsDir() {
+		return nil
+	}
+
+	if state.index != nil {
+		state.index.begin()
+	}
+	err = w.walkTree(state, realRoot, "", newDirEntry(rootInfo), []string{realRoot})
+	if state.index != nil {
+		state.index.end(err == nil)
+	}
+	w.partials = state.partials
+
+	return err
+}
+
+// WalkSubtree walks the entry at rel, a path relative to the root, and
+// everything below it, with the ignore rules and symlink handling that a
+// whole walk would apply there. Nothing is reported when the entry does
+// not exist or a whole walk would leave it out, and "." walks the whole
+// tree. The walker's index and partial files are left alone, so it may
+// run alongside Walk.
+func (w *LocalWalker) WalkSubtree(rel string, fn func(FileInfo) error) error {
+	rootRules := w.ignore
+	if rootRules == nil {
+		rootRules = &IgnoreRules{}
+	}
+
+	rules, err := rootRules.loadIgnoreFile(w.root, "")
+	if err != nil {
+		return err
+	}
+
+	state := &walkState{
+		fn:       fn,
+		dirRules: []dirRules{{".", rules}},
+	}
+
+	realRoot, err := filepath.EvalSymlinks(w.root)
+	if err != nil {
+		return fmt.Errorf("resolve root: %w", err)
+	}
+	chain := []string{realRoot}
+
+	if filepath.Clean(rel) == "." {
+		rootInfo, err := os.Stat(realRoot)
+		if err != nil {
+			return fmt.Errorf("walk error at %s: %w", w.root, err)
+		}
+		return w.walkTree(state, realRoot, "", newDirEntry(rootInfo), chain)
+	}
+
+	// Collect the rules of every directory above the entry
+	parts := strings.Split(filepath.Clean(rel), string(filepath.Separator))
+	dir := w.root
+	for i, name := range parts[:len(parts)-1] {
+		path := filepath.Join(dir, name)
+		slashPath := pathpkg.Join(parts[:i+1]...)
+		if IsInternal(name) || rules.Match(slashPath, true) {
+			return nil
+		}
+
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
 		if err != nil {
 			return fmt.Errorf("walk error at %s: %w", path, err)
 		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			// Only followed links to directories are walked through
+			if w.symlinks != SymlinkFollow {
+				return nil
+			}
+			if target, err := os.Stat(path); err != nil || !target.IsDir() {
+				return nil
+			}
+			linkedDir, ok := resolveDirLink(path, chain)
+			if !ok {
+				return nil
+			}
+			chain = append(chain, linkedDir)
+		} else if !info.IsDir() {
+			return nil
+		}
 
-		// Get relative path from root
-		relPath, err := filepath.Rel(w.root, path)
+		rules, err = rules.loadIgnoreFile(path, slashPath)
 		if err != nil {
-			return fmt.Errorf("get relative path: %w", err)
+			return err
 		}
+		state.dirRules = append(state.dirRules, dirRules{slashPath, rules})
+		dir = path
+	}
 
-		// Skip root directory itself
-		if relPath == "." {
+	name := parts[len(parts)-1]
+	info, err := os.Lstat(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get file info for %s: %w", filepath.Join(dir, name), err)
+	}
+
+	return w.visit(state, dir, filepath.Dir(filepath.Clean(rel)), newDirEntry(info), chain)
+}
+
+// walkTree walks the contents of dir, whose own entry is self, reporting
+// paths prefixed with relPrefix. chain holds the real paths of the root
+// and of every directory link followed to get here, so a link pointing
+// back into the chain is detected as a loop.
+func (w *LocalWalker) walkTree(state *walkState, dir, relPrefix string, self dirEntry, chain []string) error {
+	entries, err := w.list(state, dir, relPrefix, self)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := w.visit(state, dir, relPrefix, entry, chain); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// visit reports entry, found in dir, and walks its contents if it is a
+// directory, unless it is skipped or ignored.
+func (w *LocalWalker) visit(state *walkState, dir, relPrefix string, entry dirEntry, chain []string) error {
+	path := filepath.Join(dir, entry.Name)
+	relPath := filepath.Join(relPrefix, entry.Name)
+
+	// Skip MirrorBox's own temporary files
+	if IsInternal(entry.Name) {
+		if !entry.isDir() && IsPartial(entry.Name) {
+			state.partials = append(state.partials, filepath.Join(w.root, relPath))
+		}
+		return nil
+	}
+
+	isLink := entry.Mode&fs.ModeSymlink != 0
+	if isLink && w.symlinks == SymlinkSkip {
+		return nil
+	}
+
+	// Use the target's entry when following links
+	info := entry
+	if isLink && w.symlinks == SymlinkFollow {
+		target, err := os.Stat(path)
+		if err != nil {
+			log.Printf("Skipping broken symlink %s: %v", path, err)
+			return nil
+		}
+		info = newDirEntry(target)
+	}
+
+	// Resolve linked directories up front so loops are never reported
+	var linkedDir string
+	if isLink && info.isDir() {
+		var ok bool
+		if linkedDir, ok = resolveDirLink(path, chain); !ok {
 			return nil
 		}
+	}
+
+	// Apply ignore rules, pruning excluded directories entirely
+	slashPath := filepath.ToSlash(relPath)
+	rules := state.rulesFor(pathpkg.Dir(slashPath))
+	if rules.Match(slashPath, info.isDir()) {
+		return nil
+	}
+	if info.isDir() {
+		var err error
+		rules, err = rules.loadIgnoreFile(path, slashPath)
+		if err != nil {
+			return err
+		}
+		state.dirRules = append(state.dirRules, dirRules{slashPath, rules})
+	}
+
+	fileInfo := FileInfo{
+		Path:    relPath,
+		Size:    info.Size,
+		ModTime: time.Unix(0, info.ModTime).Unix(),
+		IsDir:   info.isDir(),
+	}
+
+	if !isLink && info.Mode.IsRegular() {
+		fileInfo.Dev, fileInfo.Ino, fileInfo.Nlink = info.Dev, info.Ino, info.Nlink
+	}
+
+	if isLink && w.symlinks == SymlinkPreserve {
+		fileInfo.IsSymlink = true
+		target, err := os.Readlink(path)
+		if err != nil {
+			return fmt.Errorf("read symlink %s: %w", path, err)
+		}
+		fileInfo.LinkTarget = target
+	}
+
+	if err := state.fn(fileInfo); err != nil {
+		return err
+	}
+
+	switch {
+	case linkedDir != "":
+		return w.walkTree(state, linkedDir, relPath, info, append(chain[:len(chain):len(chain)], linkedDir))
+	case info.isDir():
+		return w.walkTree(state, path, relPath, info, chain)
+	}
+
+	return nil
+}
+
+// list returns the entries of dir sorted by name. They come from the index
+// when it shows dir unchanged, in which case only its subdirectories are
+// looked at again, since changes inside them do not show on dir itself.
+func (w *LocalWalker) list(state *walkState, dir, relPrefix string, self dirEntry) ([]dirEntry, error) {
+	key := filepath.ToSlash(relPrefix)
+	if key == "" {
+		key = "."
+	}
+
+	if state.index != nil {
+		if recorded, ok := state.index.lookup(key, self); ok {
+			if entries, ok := refreshDirs(dir, recorded); ok {
+				state.index.record(key, self, entries)
+				return entries, nil
+			}
+		}
+	}
 
-		// Get file info
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("walk error at %s: %w", dir, err)
+	}
+
+	entries := make([]dirEntry, 0, len(dirEntries))
+	for _, d := range dirEntries {
 		info, err := d.Info()
 		if err != nil {
-			return fmt.Errorf("get file info for %s: %w", path, err)
+			return nil, fmt.Errorf("get file info for %s: %w", filepath.Join(dir, d.Name()), err)
 		}
+		entries = append(entries, newDirEntry(info))
+	}
+
+	if state.index != nil {
+		state.index.record(key, self, entries)
+	}
 
-		fileInfo := FileInfo{
-			Path:    relPath,
-			Size:    info.Size(),
-			ModTime: info.ModTime().Unix(),
-			IsDir:   info.IsDir(),
+	return entries, nil
+}
+
+// refreshDirs returns a copy of the recorded entries of dir with those of
+// its subdirectories read again. ok is false when one of them is gone.
+func refreshDirs(dir string, recorded []dirEntry) (entries []dirEntry, ok bool) {
+	entries = append([]dirEntry(nil), recorded...)
+	for i, entry := range entries {
+		if !entry.isDir() {
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(dir, entry.Name))
+		if err != nil || !info.IsDir() {
+			return nil, false
+		}
+		entries[i] = newDirEntry(info)
+	}
+	return entries, true
+}
+
+// resolveDirLink returns the real directory a followed link points to.
+// ok is false when following it would loop back into a directory that is
+// already being walked.
+func resolveDirLink(linkPath string, chain []string) (target string, ok bool) {
+	target, err := filepath.EvalSymlinks(linkPath)
+	if err != nil {
+		log.Printf("Skipping symlink %s: %v", linkPath, err)
+		return "", false
+	}
+
+	for _, dir := range chain {
+		if target == dir || strings.HasPrefix(dir, target+string(filepath.Separator)) {
+			log.Printf("Skipping symlink loop %s -> %s", linkPath, target)
+			return "", false
 		}
+	}
+
+	return target, true
+}
+
+// ComparePaths orders relative paths component by component, which is the
+// order LocalWalker reports them in: a directory's contents come directly
+// after it and before any sibling sorting after its name ("a", "a/b", "a.txt").
+func ComparePaths(a, b string) int {
+	for {
+		ca, restA, moreA := strings.Cut(a, string(filepath.Separator))
+		cb, restB, moreB := strings.Cut(b, string(filepath.Separator))
+		if c := strings.Compare(ca, cb); c != 0 {
+			return c
+		}
+		switch {
+		case !moreA && !moreB:
+			return 0
+		case !moreA:
+			return -1
+		case !moreB:
+			return 1
+		}
+		a, b = restA, restB
+	}
+}
 
-		return fn(fileInfo)
-	})
+// IsInternal reports whether name belongs to MirrorBox itself, such as
+// the temporary files written during an update. Walkers never report them.
+func IsInternal(name string) bool {
+	return strings.HasPrefix(name, ".mirrorbox-")
 }
 
 // Exists checks if a path exists on local filesystem.
@@ -0,0 +1,113 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestComparePaths(t *testing.T) {
+	sep := string(filepath.Separator)
+	// In ComparePaths order; a plain string sort puts "a.txt" and "a-b"
+	// before "a/b", because '.' and '-' sort before the separator.
+	ordered := []string{
+		"a",
+		"a" + sep + "b",
+		"a" + sep + "b" + sep + "c",
+		"a" + sep + "c",
+		"a-b",
+		"a.txt",
+		"b",
+		"b" + sep + "a",
+	}
+
+	for i, a := range ordered {
+		for j, b := range ordered {
+			got := ComparePaths(a, b)
+			want := 0
+			switch {
+			case i < j:
+				want = -1
+			case i > j:
+				want = 1
+			}
+			if got != want {
+				t.Errorf("ComparePaths(%q, %q) = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+}
+
+func TestLocalWalkerOrder(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"a/b", "a-b", "c"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"a/b/x", "a/y", "a.txt", "a-b/z", "c/w", ".mirrorbox-partial-q"} {
+		if err := os.WriteFile(filepath.Join(root, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var paths []string
+	if err := NewLocalWalker(root).Walk(func(info FileInfo) error {
+		paths = append(paths, info.Path)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !sort.SliceIsSorted(paths, func(i, j int) bool { return ComparePaths(paths[i], paths[j]) < 0 }) {
+		t.Errorf("walk order %q is not ComparePaths order", paths)
+	}
+	if len(paths) != 9 {
+		t.Errorf("got %d entries %q, want 9", len(paths), paths)
+	}
+}
+
+func TestLocalWalkerNestedIgnoreFiles(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a/.mirrorboxignore":   "*.tmp\n",
+		"a/b/.mirrorboxignore": "!keep.tmp\n",
+		"a/b/keep.tmp":         "",
+		"a/b/drop.tmp":         "",
+		"a/c/drop.tmp":         "",
+		"a/keep.tmp":           "",
+		"d/keep.tmp":           "",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	if err := NewLocalWalker(root).Walk(func(info FileInfo) error {
+		seen[filepath.ToSlash(info.Path)] = true
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rules from a/b must not leak into its sibling a/c or back into a
+	tests := map[string]bool{
+		"a/b/keep.tmp": true,
+		"a/b/drop.tmp": false,
+		"a/c/drop.tmp": false,
+		"a/keep.tmp":   false,
+		"d/keep.tmp":   true,
+	}
+	for path, want := range tests {
+		if seen[path] != want {
+			t.Errorf("%s reported = %v, want %v", path, seen[path], want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ErrWatchOverflow is returned by TreeWatcher.Watch when the system
+// dropped events, so some changes were missed.
+var ErrWatchOverflow = errors.New("filesystem events were lost")
+
+// ErrWatchLimit is returned when the tree has more directories than the
+// system lets a process watch.
+var ErrWatchLimit = errors.New("too many directories to watch")
+
+// TreeWatcher reports changes below the root of a LocalWalker as they
+// happen. It watches the directories a walk would list, which leaves out
+// ignored and internal ones, and adds new directories as they appear.
+type TreeWatcher struct {
+	walker  *LocalWalker
+	watcher *fsnotify.Watcher
+}
+
+// NewTreeWatcher starts watching every directory the walker would list.
+// Close it when done.
+func NewTreeWatcher(walker *LocalWalker) (*TreeWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("create watcher: %w", err)
+	}
+
+	t := &TreeWatcher{walker: walker, watcher: watcher}
+	if err := t.add(walker.root); err == nil {
+		err = t.addTree(".")
+	}
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Watch calls changed with the path, relative to the root, of every entry
+// created, written, removed, renamed or whose attributes changed, and "."
+// when the root itself goes away. It runs until ctx is cancelled or the
+// watch breaks down with ErrWatchOverflow, ErrWatchLimit or another error;
+// only a look at the whole tree tells what changed after that.
+func (t *TreeWatcher) Watch(ctx context.Context, changed func(path string)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case err, ok := <-t.watcher.Errors:
+			if !ok {
+				return fsnotify.ErrClosed
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				return ErrWatchOverflow
+			}
+			return fmt.Errorf("watch %s: %w", t.walker.root, err)
+
+		case event, ok := <-t.watcher.Events:
+			if !ok {
+				return fsnotify.ErrClosed
+			}
+			rel, err := filepath.Rel(t.walker.root, event.Name)
+			if err != nil || IsInternal(filepath.Base(rel)) {
+				continue
+			}
+
+			// Directories created since the watch began are watched too
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+					if err := t.addTree(rel); err != nil {
+						return err
+					}
+				}
+			}
+			changed(rel)
+		}
+	}
+}
+
+// Close stops watching.
+func (t *TreeWatcher) Close() error {
+	return t.watcher.Close()
+}
+
+// addTree watches rel and every directory below it.
+func (t *TreeWatcher) addTree(rel string) error {
+	return t.walker.WalkSubtree(rel, func(info FileInfo) error {
+		if !info.IsDir {
+			return nil
+		}
+		return t.add(filepath.Join(t.walker.root, info.Path))
+	})
+}
+
+// add watches one directory. One removed before it could be watched is
+// skipped; its removal is reported to the watch of its parent.
+func (t *TreeWatcher) add(dir string) error {
+	err := t.watcher.Add(dir)
+	switch {
+	case err == nil, errors.Is(err, os.ErrNotExist):
+		return nil
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EMFILE):
+		return ErrWatchLimit
+	default:
+		return fmt.Errorf("watch %s: %w", dir, err)
+	}
+}
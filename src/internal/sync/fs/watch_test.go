@@ -0,0 +1,74 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTreeWatcher(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"a", "ignored"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rules, err := ParseIgnoreRules([]string{"ignored/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	walker := NewLocalWalker(root)
+	walker.SetIgnoreRules(rules)
+
+	watcher, err := NewTreeWatcher(walker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	changes := make(chan string, 100)
+	go watcher.Watch(ctx, func(path string) { changes <- filepath.ToSlash(path) })
+
+	// wait blocks until path is reported
+	wait := func(path string) {
+		t.Helper()
+		for {
+			select {
+			case got := <-changes:
+				if got == "ignored/x" {
+					t.Errorf("change in an ignored directory reported")
+				}
+				if got == path {
+					return
+				}
+			case <-ctx.Done():
+				t.Fatalf("%s not reported", path)
+			}
+		}
+	}
+
+	write := func(path string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(root, filepath.FromSlash(path)), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("ignored/x")
+	write("a/one.txt")
+	wait("a/one.txt")
+
+	// A new directory is watched as soon as it is reported
+	if err := os.Mkdir(filepath.Join(root, "a", "new"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	wait("a/new")
+	write("a/new/two.txt")
+	wait("a/new/two.txt")
+}
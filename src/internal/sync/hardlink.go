@@ -0,0 +1,71 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"excellgene.com/mirrorBox/internal/sync/fs"
+)
+
+// hardLinkLeaders groups hard-linked source files by device and inode and
+// maps every member but the first (in path order) to that first member.
+// The leader is copied; the others are linked to its copy.
+func hardLinkLeaders(source []fs.FileInfo) map[string]string {
+	type identity struct{ dev, ino uint64 }
+	groups := make(map[identity][]string)
+
+	for _, f := range source {
+		if f.HardLinked() {
+			id := identity{f.Dev, f.Ino}
+			groups[id] = append(groups[id], f.Path)
+		}
+	}
+
+	links := make(map[string]string)
+	for _, paths := range groups {
+		if len(paths) < 2 {
+			continue // other links are outside the synced tree
+		}
+		sort.Strings(paths)
+		for _, p := range paths[1:] {
+			links[p] = paths[0]
+		}
+	}
+
+	return links
+}
+
+// hardLink makes the destination path of diff another name for leader, the
+// destination path of the group's first file, replacing whatever is there.
+func (s *Syncer) hardLink(ctx context.Context, diff FileDiff, leader, destPath string) error {
+	dstPath := filepath.Join(destPath, diff.target())
+	leaderPath := filepath.Join(destPath, leader)
+
+	if err := s.keepVersion(ctx, destPath, diff.target()); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return fmt.Errorf("create parent directories: %w", err)
+	}
+
+	// Link under a temporary name, then rename over the old entry
+	tmpPath := filepath.Join(filepath.Dir(dstPath), ".mirrorbox-tmp-link-"+filepath.Base(dstPath))
+	os.Remove(tmpPath)
+	if err := os.Link(leaderPath, tmpPath); err != nil {
+		return fmt.Errorf("create hard link: %w", err)
+	}
+	if err := os.Rename(tmpPath, dstPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("rename hard link: %w", err)
+	}
+
+	// Renaming onto another link to the same file is a no-op that leaves
+	// the temporary name behind.
+	os.Remove(tmpPath)
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package sync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"excellgene.com/mirrorBox/internal/sync/fs"
+)
+
+func TestHardLinkLeaders(t *testing.T) {
+	linked := func(path string, ino, nlink uint64) fs.FileInfo {
+		f := testFile(path, 1, 100)
+		f.Dev, f.Ino, f.Nlink = 1, ino, nlink
+		return f
+	}
+
+	source := []fs.FileInfo{
+		linked("c", 1, 3), linked("a", 1, 3), linked("b", 1, 3),
+		linked("x", 2, 2), linked("y", 2, 2),
+		linked("lone", 3, 2), // its other link is outside the tree
+		linked("plain", 4, 1),
+	}
+	want := map[string]string{"b": "a", "c": "a", "y": "x"}
+
+	got := hardLinkLeaders(source)
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for path, leader := range want {
+		if got[path] != leader {
+			t.Errorf("%s: leader %q, want %q", path, got[path], leader)
+		}
+	}
+}
+
+func TestRunHardLinks(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"b", "c"} {
+		if err := os.Link(filepath.Join(src, "a"), filepath.Join(src, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	job := NewJob("test", src, dst, Options{})
+	result, err := job.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FilesCreated != 3 || result.HardLinks != 2 || len(result.Warnings) != 0 {
+		t.Fatalf("created %d with %d links and warnings %v, want 3 with 2 links", result.FilesCreated, result.HardLinks, result.Warnings)
+	}
+
+	leader, err := os.Stat(filepath.Join(dst, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"b", "c"} {
+		info, err := os.Stat(filepath.Join(dst, name))
+		if err != nil || !os.SameFile(leader, info) {
+			t.Errorf("%s is not linked to a (%v)", name, err)
+		}
+	}
+}
+
+func TestSyncHardLinkFallback(t *testing.T) {
+	tests := []struct {
+		name         string
+		leaderDiff   bool // the leader is created along with the member
+		leaderIsDir  bool // the leader's destination entry cannot be linked to
+		wantErrors   int
+		wantWarnings int
+	}{
+		{name: "leader failed", leaderDiff: true, wantErrors: 1},
+		{name: "leader skipped", wantWarnings: 1},
+		{name: "linking unsupported", leaderIsDir: true, wantWarnings: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := t.TempDir(), t.TempDir()
+			if err := os.WriteFile(filepath.Join(src, "b"), []byte("b"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.leaderIsDir {
+				if err := os.Mkdir(filepath.Join(dst, "a"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			leader, member := testFile("a", 1, 100), testFile("b", 1, 100)
+			diff := &DiffResult{
+				Diffs: []FileDiff{{Path: "b", Action: ActionCreate, Source: &member}},
+				Links: map[string]string{"b": "a"},
+			}
+			if tt.leaderDiff {
+				// The leader's source is missing, so its copy fails
+				diff.Diffs = append(diff.Diffs, FileDiff{Path: "a", Action: ActionCreate, Source: &leader})
+			}
+
+			s := NewSyncer(fs.NewLocalCopier(true))
+			result, err := s.Sync(context.Background(), diff, src, dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Errors) != tt.wantErrors || len(result.Warnings) != tt.wantWarnings {
+				t.Errorf("errors %v and warnings %v, want %d and %d", result.Errors, result.Warnings, tt.wantErrors, tt.wantWarnings)
+			}
+			if result.HardLinks != 0 || result.FilesCreated != 1 {
+				t.Errorf("created %d with %d links, want the member copied", result.FilesCreated, result.HardLinks)
+			}
+			if data, err := os.ReadFile(filepath.Join(dst, "b")); err != nil || string(data) != "b" {
+				t.Errorf("member holds %q (%v), want a copy", data, err)
+			}
+		})
+	}
+}
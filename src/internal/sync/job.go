@@ -2,7 +2,12 @@ package sync
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	gosync "sync"
 	"time"
 
 	"excellgene.com/mirrorBox/internal/sync/fs"
@@ -18,16 +23,155 @@ const (
 	StatusError                    // Last run failed
 )
 
+// Options holds the per-job settings. The zero value is a plain one-way copy
+// that never deletes anything at the destination.
+type Options struct {
+	// DeleteExtraFiles removes destination entries missing at the source.
+	DeleteExtraFiles bool
+	// MaxDeletes aborts a run that would delete more entries (0 = no limit).
+	MaxDeletes int
+	// MaxDeletePercent aborts a run that would delete more than this
+	// percentage of the destination entries (0 = no limit), rounded up so
+	// small trees can still lose an entry.
+	MaxDeletePercent int
+
+	// Compare selects how changed files are detected.
+	Compare CompareMode
+
+	// TwoWay propagates changes made on either side to the other, using the
+	// snapshot stored after the previous run to tell which side changed.
+	TwoWay bool
+
+	// Conflicts decides how files changed on both sides are resolved.
+	Conflicts ConflictPolicy
+
+	// Ignore excludes matching paths on both sides. Nil ignores nothing
+	// except the rules in .mirrorboxignore files.
+	Ignore *fs.IgnoreRules
+
+	// Symlinks selects how links in the source are handled. RewriteLinks
+	// points recreated absolute links inside the source at the destination.
+	Symlinks     fs.SymlinkMode
+	RewriteLinks bool
+
+	// Delta sends large modified files as a delta against the existing
+	// destination copy instead of copying them whole.
+	Delta bool
+
+	// Concurrency is the number of files transferred in parallel.
+	// 0 selects DefaultConcurrency.
+	Concurrency int
+
+	// Versioning keeps the previous contents of overwritten and deleted
+	// files under VersionsDir and decides when they are pruned.
+	Versioning Versioning
+
+	// RateLimiter throttles the job's transfers. It may be shared with
+	// other jobs to enforce a global limit. Nil is unlimited.
+	RateLimiter *fs.RateLimiter
+
+	// Verify reads every copied file back and compares it with the source
+	// data. Mismatches are retried, then reported as *fs.VerifyError.
+	Verify bool
+
+	// Fsync flushes every written file and its directory to disk before it
+	// is counted as synced, so it survives a crash or power loss. Slower,
+	// particularly on removable drives.
+	Fsync bool
+
+	// Metadata selects the extended metadata preserved on files and
+	// directories, on top of permissions and file modification times.
+	Metadata fs.MetadataOptions
+
+	// Streaming walks both sides concurrently and starts copying as soon as
+	// differences are found, without holding either listing in memory.
+	// What it does keep grows with the changes rather than the tree: the
+	// directories written to, whose metadata is copied at the end, and the
+	// topmost path of each pending deletion. It only applies to one-way
+	// jobs that match names byte for byte, and leaves out move and
+	// hard-link detection, which need whole listings. Plans and previews
+	// are still computed from whole listings.
+	Streaming bool
+
+	// IncrementalScan keeps an index of both trees and only lists the
+	// directories that changed since the previous run. Files rewritten in
+	// place without touching their directory are picked up by the full
+	// rescan made every FullRescan (0 selects fs.DefaultFullRescan).
+	IncrementalScan bool
+	FullRescan      time.Duration
+
+	// Continuous asks for the source to be watched, so changes are synced
+	// as they happen rather than only on scheduled runs. See RunSubtrees.
+	Continuous bool
+
+	// Normalization matches names in either Unicode form and writes new
+	// destination names in the selected one. CaseInsensitive matches names
+	// that only differ in letter case, for destinations that cannot store
+	// both. Source paths that would share a destination name are reported
+	// as *NameCollisionError and not synced.
+	Normalization   fs.Normalization
+	CaseInsensitive bool
+
+	// SanitizeNames gives destination entries names that Windows, exFAT and
+	// FAT32 can store, encoding forbidden characters, trailing dots and
+	// spaces, and reserved names such as CON with fs.SanitizeName. The
+	// names given are remembered in StateDir. Names that cannot be stored
+	// are reported as *fs.NameError and not synced.
+	SanitizeNames bool
+
+	// StateDir is where the job keeps persistent state such as the
+	// checksum cache. Empty keeps all state in memory.
+	StateDir string
+}
+
+// DeleteLimitError is returned when a run would delete more entries than
+// the job's safety limit allows. Nothing is applied.
+type DeleteLimitError struct {
+	Side    string // "source" or "destination"
+	Deletes int    // deletions the run would have made
+	Limit   int    // maximum deletions allowed
+	Total   int    // entries found on that side
+}
+
+func (e *DeleteLimitError) Error() string {
+	return fmt.Sprintf("aborted: %d deletions exceed the safety limit of %d (%s has %d entries)",
+		e.Deletes, e.Limit, e.Side, e.Total)
+}
+
+// ErrJobRunning is returned when a job is asked to run, plan or apply a
+// plan while it is already doing one of those.
+var ErrJobRunning = errors.New("job is already running")
+
 type Job struct {
 	Name            string
 	SourcePath      string
 	DestinationPath string
+	Options         Options
+
+	// busy is held by Run, Plan and Apply, which share the walkers, the
+	// caches and the persistent state below. It is shared with every other
+	// job of the same state, see stateLock.
+	busy *gosync.Mutex
 
 	// Dependencies
 	sourceWalker fs.Walker
 	destWalker   fs.Walker
 	differ       *Differ
 	syncer       *Syncer
+	checksums    *fs.ChecksumCache
+	state        *SyncState
+	inodes       *InodeMap
+	names        *NameMap
+	indexes      []*fs.Index
+
+	// caps is what the destination filesystem can store, found before the
+	// first run. Nil until then.
+	caps *fs.Capabilities
+
+	// destCount is the number of destination entries found by the last
+	// whole walk, which deletion limits of subtree runs are measured by.
+	// It is -1 until then.
+	destCount int
 
 	// State
 	status     JobStatus
@@ -36,17 +180,105 @@ type Job struct {
 	lastError  error
 }
 
+// stateLocks holds the run lock of each job state, so a job recreated for
+// the same state, as happens when settings are saved, cannot start while
+// the one it replaced is still running.
+var stateLocks = struct {
+	mu    gosync.Mutex
+	locks map[string]*gosync.Mutex
+}{locks: make(map[string]*gosync.Mutex)}
+
+// stateLock returns the run lock of the jobs keeping their state in
+// stateDir, or of those syncing the same folders when it is empty.
+func stateLock(stateDir, sourcePath, destPath string) *gosync.Mutex {
+	key := stateDir
+	if key == "" {
+		key = sourcePath + "\x00" + destPath
+	}
+
+	stateLocks.mu.Lock()
+	defer stateLocks.mu.Unlock()
+	lock, ok := stateLocks.locks[key]
+	if !ok {
+		lock = new(gosync.Mutex)
+		stateLocks.locks[key] = lock
+	}
+	return lock
+}
+
 // NewJob creates a new sync job.
 // sourceWalker walks the local filesystem.
-func NewJob(name, sourcePath, destPath string) *Job {
+func NewJob(name, sourcePath, destPath string, opts Options) *Job {
+	differ := NewDiffer()
+	differ.DeleteExtraFiles = opts.DeleteExtraFiles
+	differ.Compare = opts.Compare
+	differ.SourceRoot = sourcePath
+	differ.DestRoot = destPath
+	differ.RewriteLinks = opts.RewriteLinks
+	differ.DirTimes = opts.Metadata.DirTimes
+	differ.Normalization = opts.Normalization
+	differ.FoldCase = opts.CaseInsensitive
+	differ.Sanitize = opts.SanitizeNames
+
+	copier := fs.NewLocalCopier(true)
+	copier.SetRateLimiter(opts.RateLimiter)
+	copier.SetVerify(opts.Verify)
+	copier.SetFsync(opts.Fsync)
+	copier.SetMetadata(opts.Metadata)
+
+	syncer := NewSyncer(copier)
+	syncer.conflicts = opts.Conflicts
+	syncer.twoWay = opts.TwoWay
+	syncer.rewriteLinks = opts.RewriteLinks
+	syncer.delta = opts.Delta
+	syncer.concurrency = opts.Concurrency
+	syncer.versioning = opts.Versioning
+	syncer.metadata = opts.Metadata
+
+	var checksums *fs.ChecksumCache
+	if opts.Compare != CompareSizeModTime {
+		cachePath := ""
+		if opts.StateDir != "" {
+			cachePath = filepath.Join(opts.StateDir, "checksums.json")
+		}
+		checksums = fs.NewChecksumCache(cachePath)
+		differ.Checksums = checksums
+		syncer.checksums = checksums
+	}
+
+	sourceWalker := fs.NewLocalWalker(sourcePath)
+	sourceWalker.SetIgnoreRules(opts.Ignore)
+	sourceWalker.SetSymlinkMode(opts.Symlinks)
+	destWalker := fs.NewLocalWalker(destPath)
+	destWalker.SetIgnoreRules(opts.Ignore)
+
+	var indexes []*fs.Index
+	if opts.IncrementalScan {
+		sourceIndexPath, destIndexPath := "", ""
+		if opts.StateDir != "" {
+			sourceIndexPath = filepath.Join(opts.StateDir, "index-source.json")
+			destIndexPath = filepath.Join(opts.StateDir, "index-destination.json")
+		}
+		sourceIndex := fs.NewIndex(sourceIndexPath, opts.FullRescan)
+		destIndex := fs.NewIndex(destIndexPath, opts.FullRescan)
+		sourceWalker.SetIndex(sourceIndex)
+		destWalker.SetIndex(destIndex)
+		indexes = []*fs.Index{sourceIndex, destIndex}
+	}
+
 	return &Job{
 		Name:            name,
 		SourcePath:      sourcePath,
 		DestinationPath: destPath,
-		sourceWalker:    fs.NewLocalWalker(sourcePath),
-		destWalker:      fs.NewLocalWalker(destPath),
-		differ:          NewDiffer(),
-		syncer:          NewSyncer(fs.NewLocalCopier(true)),
+		Options:         opts,
+		sourceWalker:    sourceWalker,
+		destWalker:      destWalker,
+		differ:          differ,
+		syncer:          syncer,
+		checksums:       checksums,
+		indexes:         indexes,
+		busy:            stateLock(opts.StateDir, sourcePath, destPath),
+		destCount:       -1,
 		status:          StatusIdle,
 	}
 }
@@ -56,40 +288,96 @@ func NewJob(name, sourcePath, destPath string) *Job {
 //  1. Walk source filesystem
 //  2. Walk destination filesystem
 //  3. Compute diff
-//  4. Apply sync operations
+//  4. Check the deletion safety limit
+//  5. Apply sync operations
 //
+// Steps 1-4 are Plan; step 5 is Apply. Streaming jobs overlap all five
+// steps instead.
 // Returns SyncResult with statistics and any errors encountered.
 func (j *Job) Run(ctx context.Context) (*SyncResult, error) {
+	if !j.busy.TryLock() {
+		return nil, ErrJobRunning
+	}
+	defer j.busy.Unlock()
+
+	return j.run(ctx)
+}
+
+func (j *Job) run(ctx context.Context) (*SyncResult, error) {
 	j.status = StatusRunning
 	j.lastRun = time.Now()
 
-	var sourceFiles []fs.FileInfo
-	err := j.sourceWalker.Walk(func(info fs.FileInfo) error {
-		sourceFiles = append(sourceFiles, info)
-		return nil
-	})
+	// Before the streaming check: the profile can rule out exact names
+	j.probeDestination()
+
+	if j.Options.Streaming && !j.Options.TwoWay && j.differ.exactNames() {
+		return j.runStreaming(ctx)
+	}
+
+	plan, err := j.plan(ctx)
 	if err != nil {
 		j.status = StatusError
-		j.lastError = fmt.Errorf("walk source: %w", err)
-		return nil, j.lastError
+		j.lastError = err
+		return nil, err
 	}
 
-	var destFiles []fs.FileInfo
-	if j.destWalker != nil {
-		err = j.destWalker.Walk(func(info fs.FileInfo) error {
-			destFiles = append(destFiles, info)
-			return nil
-		})
-		if err != nil {
-			j.status = StatusError
-			j.lastError = fmt.Errorf("walk destination: %w", err)
-			return nil, j.lastError
-		}
+	return j.apply(ctx, plan)
+}
+
+// Apply performs a plan returned by Plan, exactly as previewed. Paths that
+// changed on disk since the plan was made may fail and are reported in the
+// result's errors.
+func (j *Job) Apply(ctx context.Context, plan *Plan) (*SyncResult, error) {
+	if plan.job != j {
+		return nil, fmt.Errorf("plan belongs to a different job")
+	}
+	if !j.busy.TryLock() {
+		return nil, ErrJobRunning
+	}
+	defer j.busy.Unlock()
+
+	j.status = StatusRunning
+	j.lastRun = time.Now()
+
+	return j.apply(ctx, plan)
+}
+
+func (j *Job) apply(ctx context.Context, plan *Plan) (*SyncResult, error) {
+	if plan.Blocked != nil {
+		j.status = StatusError
+		j.lastError = plan.Blocked
+		return nil, plan.Blocked
 	}
 
-	diffResult := j.differ.Diff(sourceFiles, destFiles)
+	diffResult := plan.Diff
+	sourceFiles, destFiles := plan.sourceFiles, plan.destFiles
 
 	syncResult, err := j.syncer.Sync(ctx, diffResult, j.SourcePath, j.DestinationPath)
+	j.saveChecksums(sourceFiles, destFiles)
+	// Names first: the two-way state matches destination entries by them
+	if j.names != nil && err == nil {
+		j.saveNames(diffResult, syncResult)
+	}
+	if j.Options.TwoWay && err == nil {
+		j.saveState(sourceFiles, destFiles, diffResult, syncResult)
+	}
+	if j.inodes != nil && err == nil {
+		j.saveInodes(sourceFiles, syncResult)
+	}
+	if err == nil {
+		inUse := make(map[string]bool)
+		for _, d := range diffResult.Diffs {
+			markPartials(inUse, d, j.SourcePath, j.DestinationPath)
+		}
+		j.removeStalePartials(plan.partials, inUse)
+	}
+	j.pruneVersions()
+
+	return j.finish(syncResult, err)
+}
+
+// finish records the outcome of a run in the job's status.
+func (j *Job) finish(syncResult *SyncResult, err error) (*SyncResult, error) {
 	if err != nil {
 		j.status = StatusError
 		j.lastError = err
@@ -109,6 +397,311 @@ func (j *Job) Run(ctx context.Context) (*SyncResult, error) {
 	return syncResult, nil
 }
 
+// pruneVersions applies the retention policy to the kept versions on each
+// side the job writes to. Failures are logged and do not fail the run.
+func (j *Job) pruneVersions() {
+	if j.Options.Versioning.Mode == VersioningOff {
+		return
+	}
+
+	roots := []string{j.DestinationPath}
+	if j.Options.TwoWay {
+		roots = append(roots, j.SourcePath)
+	}
+
+	for _, root := range roots {
+		if err := PruneVersions(root, j.Options.Versioning, time.Now()); err != nil {
+			log.Printf("Job %s: prune versions in %s: %v", j.Name, root, err)
+		}
+	}
+}
+
+// saveChecksums drops cache entries for files no longer present on either
+// side and persists the rest for the next run.
+func (j *Job) saveChecksums(sourceFiles, destFiles []fs.FileInfo) {
+	if j.checksums == nil {
+		return
+	}
+
+	seen := make(map[string]struct{}, len(sourceFiles)+len(destFiles))
+	for _, f := range sourceFiles {
+		seen[filepath.Join(j.SourcePath, f.Path)] = struct{}{}
+	}
+	for _, f := range destFiles {
+		seen[filepath.Join(j.DestinationPath, f.Path)] = struct{}{}
+	}
+
+	// Files copied during this run were not in the destination walk.
+	j.checksums.Retain(func(path string) bool {
+		if _, ok := seen[path]; ok {
+			return true
+		}
+		rel, err := filepath.Rel(j.DestinationPath, path)
+		if err != nil {
+			return false
+		}
+		_, ok := seen[filepath.Join(j.SourcePath, rel)]
+		return ok
+	})
+
+	if err := j.checksums.Save(); err != nil {
+		log.Printf("Job %s: %v", j.Name, err)
+	}
+}
+
+// loadIndexes reads the scan indexes the first time they are needed. An
+// index that cannot be read is logged and the walk lists everything.
+func (j *Job) loadIndexes() {
+	for _, index := range j.indexes {
+		if err := index.Load(); err != nil {
+			log.Printf("Job %s: %v", j.Name, err)
+		}
+	}
+}
+
+// saveIndexes persists the scan indexes after both walks completed.
+func (j *Job) saveIndexes() {
+	for _, index := range j.indexes {
+		if err := index.Save(); err != nil {
+			log.Printf("Job %s: %v", j.Name, err)
+		}
+	}
+}
+
+// loadState reads the two-way snapshot the first time it is needed.
+func (j *Job) loadState() error {
+	if j.state != nil {
+		return nil
+	}
+
+	path := ""
+	if j.Options.StateDir != "" {
+		path = filepath.Join(j.Options.StateDir, "twoway.json")
+	}
+
+	state, err := LoadSyncState(path)
+	if err != nil {
+		return fmt.Errorf("load sync state: %w", err)
+	}
+	j.state = state
+
+	return nil
+}
+
+// dropState forgets any two-way snapshot, so a stale one can never be
+// mistaken for deletions if two-way mode is switched on again later.
+func (j *Job) dropState() {
+	j.state = nil
+	if j.Options.StateDir == "" {
+		return
+	}
+	if err := os.Remove(filepath.Join(j.Options.StateDir, "twoway.json")); err != nil && !os.IsNotExist(err) {
+		log.Printf("Job %s: remove sync state: %v", j.Name, err)
+	}
+}
+
+// saveState records the post-sync snapshot. Paths that failed keep their
+// old entry so they are retried on the next run.
+func (j *Job) saveState(sourceFiles, destFiles []fs.FileInfo, diff *DiffResult, result *SyncResult) {
+	j.state.Update(sourceFiles, destFiles, diff, failedPaths(result), j.differ)
+	if err := j.state.Save(); err != nil {
+		log.Printf("Job %s: %v", j.Name, err)
+	}
+}
+
+// loadInodes reads the inode map used for move detection the first time
+// it is needed. Only mirroring jobs delete the old path of a moved file,
+// so other jobs drop the map instead.
+func (j *Job) loadInodes() error {
+	if !j.Options.DeleteExtraFiles {
+		j.inodes = nil
+		j.differ.Inodes = nil
+		return nil
+	}
+	if j.inodes != nil {
+		return nil
+	}
+
+	path := ""
+	if j.Options.StateDir != "" {
+		path = filepath.Join(j.Options.StateDir, "inodes.json")
+	}
+
+	inodes, err := LoadInodeMap(path)
+	if err != nil {
+		return fmt.Errorf("load inode map: %w", err)
+	}
+	j.inodes = inodes
+	j.differ.Inodes = inodes
+
+	return nil
+}
+
+// loadNames reads the map of sanitized destination names the first time it
+// is needed. Jobs that do not sanitize names drop it instead.
+func (j *Job) loadNames() error {
+	if !j.Options.SanitizeNames {
+		j.names = nil
+		j.differ.Names = nil
+		return nil
+	}
+	if j.names != nil {
+		return nil
+	}
+
+	path := ""
+	if j.Options.StateDir != "" {
+		path = filepath.Join(j.Options.StateDir, "names.json")
+	}
+
+	names, err := LoadNameMap(path)
+	if err != nil {
+		return fmt.Errorf("load name map: %w", err)
+	}
+	j.names = names
+	j.differ.Names = names
+
+	return nil
+}
+
+// saveNames records the names given to destination entries by the run.
+func (j *Job) saveNames(diff *DiffResult, result *SyncResult) {
+	j.names.Update(diff, failedPaths(result))
+	if err := j.names.Save(); err != nil {
+		log.Printf("Job %s: %v", j.Name, err)
+	}
+}
+
+// probeDestination finds what the destination filesystem can store the
+// first time it is needed, and adapts the job to it. The profile is kept in
+// StateDir and used when the destination cannot be probed, such as when it
+// is read-only. A destination that does not exist yet is probed next time.
+func (j *Job) probeDestination() {
+	if j.caps != nil {
+		return
+	}
+
+	path := ""
+	if j.Options.StateDir != "" {
+		path = filepath.Join(j.Options.StateDir, "capabilities.json")
+	}
+
+	caps, err := fs.ProbeCapabilities(j.DestinationPath)
+	switch {
+	case err == nil:
+		if path != "" {
+			if err := fs.SaveCapabilities(path, caps); err != nil {
+				log.Printf("Job %s: %v", j.Name, err)
+			}
+		}
+	case errors.Is(err, os.ErrNotExist):
+		return
+	default:
+		log.Printf("Job %s: probe destination: %v", j.Name, err)
+		if path == "" {
+			return
+		}
+		if caps, err = fs.LoadCapabilities(path); err != nil {
+			return
+		}
+	}
+
+	j.caps = &caps
+	j.adapt(caps)
+}
+
+// adapt makes the differ and copier fit what the destination can store:
+// coarse modification times are compared within their precision, names
+// are matched without letter case where it is not kept apart, and links
+// and extended attributes are left out where they cannot be created.
+func (j *Job) adapt(caps fs.Capabilities) {
+	j.differ.ModTimeTolerance = caps.ModTimeGranularity
+	if !caps.CaseSensitive {
+		j.differ.FoldCase = true
+	}
+	if caps.MaxNameLength < fs.MaxNameLength {
+		j.differ.MaxNameLength = caps.MaxNameLength
+	}
+
+	if !caps.Symlinks && j.Options.Symlinks == fs.SymlinkPreserve {
+		if walker, ok := j.sourceWalker.(*fs.LocalWalker); ok {
+			log.Printf("Job %s: destination cannot store symbolic links, skipping them", j.Name)
+			walker.SetSymlinkMode(fs.SymlinkSkip)
+		}
+	}
+
+	if !caps.Xattrs {
+		metadata := j.Options.Metadata
+		metadata.Xattrs, metadata.ACLs = false, false
+		j.syncer.metadata = metadata
+		if copier, ok := j.syncer.copier.(*fs.LocalCopier); ok {
+			copier.SetMetadata(metadata)
+		}
+	}
+}
+
+// saveInodes records where each source inode is after the run.
+func (j *Job) saveInodes(sourceFiles []fs.FileInfo, result *SyncResult) {
+	j.inodes.Update(sourceFiles, failedPaths(result))
+	if err := j.inodes.Save(); err != nil {
+		log.Printf("Job %s: %v", j.Name, err)
+	}
+}
+
+// failedPaths returns the paths that failed in result. Paths skipped for
+// their name are left out: they are not part of the diff, and never will be
+// while the name stays the same.
+func failedPaths(result *SyncResult) map[string]bool {
+	failed := make(map[string]bool)
+	for _, err := range result.Errors {
+		var fileErr *FileError
+		var collision *NameCollisionError
+		var nameErr *fs.NameError
+		if errors.As(err, &fileErr) && !errors.As(fileErr.Err, &collision) && !errors.As(fileErr.Err, &nameErr) {
+			failed[fileErr.Path] = true
+		}
+	}
+	return failed
+}
+
+// checkDeleteLimit refuses diffs that would remove more entries on either
+// side than the configured count or percentage allows.
+func (j *Job) checkDeleteLimit(diff *DiffResult, sourceCount, destCount int) error {
+	destDeletes, sourceDeletes := 0, 0
+	for _, d := range diff.Diffs {
+		switch d.Action {
+		case ActionDelete:
+			destDeletes++
+		case ActionDeleteSource:
+			sourceDeletes++
+		}
+	}
+
+	if err := j.deleteLimit("destination", destDeletes, destCount); err != nil {
+		return err
+	}
+	return j.deleteLimit("source", sourceDeletes, sourceCount)
+}
+
+func (j *Job) deleteLimit(side string, deletes, total int) error {
+	if deletes == 0 {
+		return nil
+	}
+
+	if limit := j.Options.MaxDeletes; limit > 0 && deletes > limit {
+		return &DeleteLimitError{Side: side, Deletes: deletes, Limit: limit, Total: total}
+	}
+
+	if pct := j.Options.MaxDeletePercent; pct > 0 {
+		limit := (total*pct + 99) / 100
+		if deletes > limit {
+			return &DeleteLimitError{Side: side, Deletes: deletes, Limit: limit, Total: total}
+		}
+	}
+
+	return nil
+}
+
 func (j *Job) Status() JobStatus {
 	return j.status
 }
@@ -0,0 +1,138 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestJobLockSharedByState(t *testing.T) {
+	src, dst, state := t.TempDir(), t.TempDir(), t.TempDir()
+
+	// A job replaced while running, as when settings are saved
+	old := NewJob("test", src, dst, Options{StateDir: state})
+	replacement := NewJob("test", src, dst, Options{StateDir: state})
+	other := NewJob("other", src, dst, Options{StateDir: filepath.Join(state, "other")})
+
+	old.busy.Lock()
+	defer old.busy.Unlock()
+
+	if _, err := replacement.Run(context.Background()); !errors.Is(err, ErrJobRunning) {
+		t.Errorf("replacement job ran alongside the old one: %v", err)
+	}
+	if _, err := replacement.Plan(context.Background()); !errors.Is(err, ErrJobRunning) {
+		t.Errorf("replacement job planned alongside the old one: %v", err)
+	}
+	if _, err := other.Run(context.Background()); err != nil {
+		t.Errorf("job with its own state: %v", err)
+	}
+}
+
+func TestCheckDeleteLimit(t *testing.T) {
+	deletes := func(dest, source int) *DiffResult {
+		diff := &DiffResult{}
+		for i := 0; i < dest; i++ {
+			diff.Diffs = append(diff.Diffs, FileDiff{Path: strconv.Itoa(i), Action: ActionDelete})
+		}
+		for i := 0; i < source; i++ {
+			diff.Diffs = append(diff.Diffs, FileDiff{Path: strconv.Itoa(i), Action: ActionDeleteSource})
+		}
+		return diff
+	}
+
+	tests := []struct {
+		name       string
+		opts       Options
+		diff       *DiffResult
+		sourceSize int
+		destSize   int
+		wantSide   string // empty when allowed
+		wantLimit  int
+	}{
+		{"no limit", Options{}, deletes(50, 50), 50, 50, "", 0},
+		{"count within", Options{MaxDeletes: 3}, deletes(3, 3), 10, 10, "", 0},
+		{"count over at destination", Options{MaxDeletes: 3}, deletes(4, 0), 10, 10, "destination", 3},
+		{"count over at source", Options{MaxDeletes: 3}, deletes(0, 4), 10, 10, "source", 3},
+		{"percent within", Options{MaxDeletePercent: 10}, deletes(10, 10), 100, 100, "", 0},
+		{"percent over at destination", Options{MaxDeletePercent: 10}, deletes(11, 0), 100, 100, "destination", 10},
+		{"percent over at source", Options{MaxDeletePercent: 10}, deletes(0, 11), 100, 100, "source", 10},
+		{"percent of a small tree rounds up", Options{MaxDeletePercent: 10}, deletes(1, 1), 5, 5, "", 0},
+		{"percent of a small tree", Options{MaxDeletePercent: 10}, deletes(2, 0), 5, 5, "destination", 1},
+		{"percent of each side", Options{MaxDeletePercent: 50}, deletes(2, 2), 2, 4, "source", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := &Job{Options: tt.opts}
+			err := j.checkDeleteLimit(tt.diff, tt.sourceSize, tt.destSize)
+
+			var limitErr *DeleteLimitError
+			if tt.wantSide == "" {
+				if err != nil {
+					t.Errorf("got %v, want no error", err)
+				}
+				return
+			}
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("got %v, want a delete limit error", err)
+			}
+			if limitErr.Side != tt.wantSide || limitErr.Limit != tt.wantLimit {
+				t.Errorf("got %s limit %d, want %s limit %d", limitErr.Side, limitErr.Limit, tt.wantSide, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestRunDeleteLimit(t *testing.T) {
+	names := []string{"a", "b", "c", "d"}
+	populate := func(t *testing.T, root string) {
+		for _, name := range names {
+			if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, side := range []string{"destination", "source"} {
+		t.Run(side, func(t *testing.T) {
+			src, dst := t.TempDir(), t.TempDir()
+			populate(t, src)
+			job := NewJob("test", src, dst, Options{DeleteExtraFiles: true, TwoWay: true, MaxDeletes: 1})
+			if _, err := job.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			// Deleting on one side deletes on the other
+			deleted, kept := src, dst
+			if side == "source" {
+				deleted, kept = dst, src
+			}
+			for _, name := range names[:2] {
+				if err := os.Remove(filepath.Join(deleted, name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(filepath.Join(deleted, "new"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var limitErr *DeleteLimitError
+			if _, err := job.Run(context.Background()); !errors.As(err, &limitErr) || limitErr.Side != side {
+				t.Fatalf("got %v, want the %s limit to trip", err, side)
+			}
+
+			// Nothing is applied, not even the new file
+			for _, name := range names {
+				if _, err := os.Stat(filepath.Join(kept, name)); err != nil {
+					t.Errorf("%s deleted despite the limit: %v", name, err)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(kept, "new")); !os.IsNotExist(err) {
+				t.Errorf("new file copied despite the limit: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"excellgene.com/mirrorBox/internal/sync/fs"
+)
+
+// InodeMap remembers the path each source inode had after the last sync,
+// so a file found under a new path can be recognised as moved.
+type InodeMap struct {
+	path  string
+	paths map[string]string // "dev:ino" -> path
+}
+
+// LoadInodeMap reads the map stored at path. A missing file yields an
+// empty map, as does an empty path (in-memory only).
+func LoadInodeMap(path string) (*InodeMap, error) {
+	m := &InodeMap{
+		path:  path,
+		paths: make(map[string]string),
+	}
+
+	if path == "" {
+		return m, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, fmt.Errorf("read inode map: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &m.paths); err != nil {
+		return nil, fmt.Errorf("parse inode map: %w", err)
+	}
+
+	return m, nil
+}
+
+// Save writes the map to disk.
+func (m *InodeMap) Save() error {
+	if m.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(m.paths)
+	if err != nil {
+		return fmt.Errorf("marshal inode map: %w", err)
+	}
+
+	if err := fs.WriteStateFile(m.path, data); err != nil {
+		return fmt.Errorf("write inode map: %w", err)
+	}
+
+	return nil
+}
+
+// Lookup returns the path f's inode had at the last sync.
+func (m *InodeMap) Lookup(f fs.FileInfo) (string, bool) {
+	if !movable(f) {
+		return "", false
+	}
+	path, ok := m.paths[inodeKey(f)]
+	return path, ok
+}
+
+// Update replaces the map with the source as it is after the sync. Inodes
+// whose path failed keep their previous entry, so the move is detected
+// again on the next run.
+func (m *InodeMap) Update(source []fs.FileInfo, failed map[string]bool) {
+	next := make(map[string]string, len(source))
+	for _, f := range source {
+		if !movable(f) {
+			continue
+		}
+		key := inodeKey(f)
+		if failed[f.Path] {
+			if old, ok := m.paths[key]; ok {
+				next[key] = old
+			}
+			continue
+		}
+		next[key] = f.Path
+	}
+	m.paths = next
+}
+
+func inodeKey(f fs.FileInfo) string {
+	return strconv.FormatUint(f.Dev, 10) + ":" + strconv.FormatUint(f.Ino, 10)
+}
+
+// movable reports whether a source file can be tracked by inode. Hard-linked
+// files are left out, as their inode belongs to several paths.
+func movable(f fs.FileInfo) bool {
+	return f.Ino != 0 && !f.IsDir && !f.IsSymlink && !f.HardLinked()
+}
+
+// detectMoves pairs creates with deletes of the path the same source inode
+// had at the last sync, and replaces each pair with an ActionMove when the
+// destination entry still matches the source file.
+func (d *Differ) detectMoves(diffs []FileDiff) []FileDiff {
+	deletes := make(map[string]int)
+	for i, diff := range diffs {
+		if diff.Action == ActionDelete {
+			deletes[d.key(diff.Path)] = i
+		}
+	}
+	if len(deletes) == 0 {
+		return diffs
+	}
+
+	moved := make(map[int]bool)
+	for i, diff := range diffs {
+		if diff.Action != ActionCreate {
+			continue
+		}
+		old, ok := d.Inodes.Lookup(*diff.Source)
+		if !ok {
+			continue
+		}
+		j, ok := deletes[d.key(old)]
+		if !ok || moved[j] {
+			continue
+		}
+		if !d.sameFile(diff.Source, diffs[j].Dest) {
+			continue
+		}
+
+		diffs[i] = FileDiff{
+			Path:     diff.Path,
+			Action:   ActionMove,
+			Source:   diff.Source,
+			Dest:     diffs[j].Dest,
+			DestPath: diff.DestPath,
+		}
+		moved[j] = true
+	}
+
+	if len(moved) == 0 {
+		return diffs
+	}
+
+	kept := diffs[:0]
+	for i, diff := range diffs {
+		if !moved[i] {
+			kept = append(kept, diff)
+		}
+	}
+	return kept
+}
+
+// sameFile reports whether dest is an unchanged copy of source under
+// another path: same size and modification time, and the same content
+// when the compare mode uses hashes.
+func (d *Differ) sameFile(source, dest *fs.FileInfo) bool {
+	if dest.IsDir || dest.IsSymlink {
+		return false
+	}
+	if source.Size != dest.Size || !d.sameTime(source.ModTime, dest.ModTime) {
+		return false
+	}
+	if d.Compare == CompareSizeModTime {
+		return true
+	}
+	return d.sameContent(source, dest, d.Compare == CompareAlwaysHash)
+}
+
+// move renames the destination copy at diff.Dest.Path to its new path. When
+// the rename fails the file is copied instead and the old copy removed.
+func (s *Syncer) move(ctx context.Context, diff FileDiff, sourcePath, destPath string) (fs.CopyStats, error) {
+	oldPath := filepath.Join(destPath, diff.Dest.Path)
+	newPath := filepath.Join(destPath, diff.target())
+
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return fs.CopyStats{}, fmt.Errorf("create parent directories: %w", err)
+	}
+
+	if err := os.Rename(oldPath, newPath); err == nil {
+		return fs.CopyStats{}, nil
+	}
+
+	create := diff
+	create.Action = ActionCreate
+	create.Dest = nil
+	stats, err := s.create(ctx, create, sourcePath, destPath)
+	if err != nil {
+		return stats, err
+	}
+	return stats, s.delete(ctx, diff.Dest.Path, destPath)
+}
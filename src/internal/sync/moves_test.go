@@ -0,0 +1,166 @@
+package sync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"excellgene.com/mirrorBox/internal/sync/fs"
+)
+
+func TestDetectMoves(t *testing.T) {
+	inode := func(f fs.FileInfo, ino uint64) fs.FileInfo {
+		f.Dev, f.Ino, f.Nlink = 1, ino, 1
+		return f
+	}
+
+	tests := []struct {
+		name   string
+		inodes map[string]string
+		source []fs.FileInfo
+		dest   []fs.FileInfo
+		want   map[string]Action
+		from   map[string]string // old path of each move
+	}{
+		{
+			name:   "rename within a directory",
+			inodes: map[string]string{"1:7": "a"},
+			source: []fs.FileInfo{inode(testFile("b", 10, 100), 7)},
+			dest:   []fs.FileInfo{testFile("a", 10, 100)},
+			want:   map[string]Action{"b": ActionMove},
+			from:   map[string]string{"b": "a"},
+		},
+		{
+			name:   "move across directories",
+			inodes: map[string]string{"1:7": filepath.Join("d1", "a")},
+			source: []fs.FileInfo{testDir("d1"), testDir("d2"), inode(testFile(filepath.Join("d2", "a"), 10, 100), 7)},
+			dest:   []fs.FileInfo{testDir("d1"), testFile(filepath.Join("d1", "a"), 10, 100)},
+			want:   map[string]Action{"d2": ActionCreate, filepath.Join("d2", "a"): ActionMove},
+			from:   map[string]string{filepath.Join("d2", "a"): filepath.Join("d1", "a")},
+		},
+		{
+			name:   "reused inode with another size",
+			inodes: map[string]string{"1:7": "a"},
+			source: []fs.FileInfo{inode(testFile("b", 11, 100), 7)},
+			dest:   []fs.FileInfo{testFile("a", 10, 100)},
+			want:   map[string]Action{"b": ActionCreate, "a": ActionDelete},
+		},
+		{
+			name:   "reused inode with another modification time",
+			inodes: map[string]string{"1:7": "a"},
+			source: []fs.FileInfo{inode(testFile("b", 10, 200), 7)},
+			dest:   []fs.FileInfo{testFile("a", 10, 100)},
+			want:   map[string]Action{"b": ActionCreate, "a": ActionDelete},
+		},
+		{
+			name:   "old path still in the source",
+			inodes: map[string]string{"1:7": "a"},
+			source: []fs.FileInfo{testFile("a", 10, 100), inode(testFile("b", 10, 100), 7)},
+			dest:   []fs.FileInfo{testFile("a", 10, 100)},
+			want:   map[string]Action{"b": ActionCreate},
+		},
+		{
+			name:   "unknown inode",
+			inodes: map[string]string{"1:8": "a"},
+			source: []fs.FileInfo{inode(testFile("b", 10, 100), 7)},
+			dest:   []fs.FileInfo{testFile("a", 10, 100)},
+			want:   map[string]Action{"b": ActionCreate, "a": ActionDelete},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDiffer()
+			d.DeleteExtraFiles = true
+			d.Inodes = &InodeMap{paths: tt.inodes}
+
+			result := d.Diff(tt.source, tt.dest)
+
+			got := make(map[string]Action)
+			for _, diff := range result.Diffs {
+				got[diff.Path] = diff.Action
+				if diff.Action == ActionMove && diff.Dest.Path != tt.from[diff.Path] {
+					t.Errorf("%q moved from %q, want %q", diff.Path, diff.Dest.Path, tt.from[diff.Path])
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for path, action := range tt.want {
+				if got[path] != action {
+					t.Errorf("%q: got %v, want %v", path, got[path], action)
+				}
+			}
+		})
+	}
+}
+
+func TestRunMoves(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	for _, dir := range []string{"d1", "d2"} {
+		if err := os.Mkdir(filepath.Join(src, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"a", filepath.Join("d1", "b")} {
+		if err := os.WriteFile(filepath.Join(src, path), []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	job := NewJob("test", src, dst, Options{DeleteExtraFiles: true})
+	if _, err := job.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	renames := map[string]string{
+		"a":                      "renamed",
+		filepath.Join("d1", "b"): filepath.Join("d2", "b"),
+	}
+	for from, to := range renames {
+		if err := os.Rename(filepath.Join(src, from), filepath.Join(src, to)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := job.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FilesMoved != 2 || result.BytesWritten != 0 || result.FilesCreated != 0 || result.FilesDeleted != 0 {
+		t.Errorf("moved %d, wrote %d bytes, created %d and deleted %d, want 2 moves and nothing else",
+			result.FilesMoved, result.BytesWritten, result.FilesCreated, result.FilesDeleted)
+	}
+	for from, to := range renames {
+		if _, err := os.Stat(filepath.Join(dst, from)); !os.IsNotExist(err) {
+			t.Errorf("%s still at the destination: %v", from, err)
+		}
+		if data, err := os.ReadFile(filepath.Join(dst, to)); err != nil || string(data) != from {
+			t.Errorf("%s holds %q (%v), want %q", to, data, err, from)
+		}
+	}
+}
+
+func TestMoveFallsBackToCopy(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "b"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old copy is gone, so the rename fails
+	source, dest := testFile("b", 1, 100), testFile("a", 1, 100)
+	diff := FileDiff{Path: "b", Action: ActionMove, Source: &source, Dest: &dest}
+
+	s := NewSyncer(fs.NewLocalCopier(true))
+	stats, err := s.move(context.Background(), diff, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.BytesWritten != 1 {
+		t.Errorf("wrote %d bytes, want the file copied", stats.BytesWritten)
+	}
+	if data, err := os.ReadFile(filepath.Join(dst, "b")); err != nil || string(data) != "b" {
+		t.Errorf("copy holds %q (%v), want %q", data, err, "b")
+	}
+}
@@ -0,0 +1,311 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"excellgene.com/mirrorBox/internal/sync/fs"
+)
+
+// NameCollisionError reports a source path that was not synced because
+// another one takes the same name at the destination, which does not tell
+// Unicode forms or letter case apart, or once names are sanitized.
+type NameCollisionError struct {
+	Other string
+}
+
+func (e *NameCollisionError) Error() string {
+	return "name collides at the destination with " + e.Other
+}
+
+// NameMap remembers the source path of each destination entry whose name
+// was changed to be stored there, so it is matched to the same source path
+// by later runs even where its name could be read back more than one way.
+type NameMap struct {
+	path  string
+	names map[string]string // destination path -> source path
+}
+
+// LoadNameMap reads the map stored at path. A missing file yields an
+// empty map, as does an empty path (in-memory only).
+func LoadNameMap(path string) (*NameMap, error) {
+	m := &NameMap{
+		path:  path,
+		names: make(map[string]string),
+	}
+
+	if path == "" {
+		return m, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, fmt.Errorf("read name map: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &m.names); err != nil {
+		return nil, fmt.Errorf("parse name map: %w", err)
+	}
+
+	return m, nil
+}
+
+// Save writes the map to disk.
+func (m *NameMap) Save() error {
+	if m.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(m.names)
+	if err != nil {
+		return fmt.Errorf("marshal name map: %w", err)
+	}
+
+	if err := fs.WriteStateFile(m.path, data); err != nil {
+		return fmt.Errorf("write name map: %w", err)
+	}
+
+	return nil
+}
+
+// Source returns the source path the destination entry at path was named
+// after.
+func (m *NameMap) Source(path string) (string, bool) {
+	source, ok := m.names[path]
+	return source, ok
+}
+
+// Update replaces the map with the renamed entries found at the
+// destination after applying diff. Paths that failed keep their previous
+// entry, if any.
+func (m *NameMap) Update(diff *DiffResult, failed map[string]bool) {
+	next := make(map[string]string, len(diff.DestPaths))
+	record := func(source, dest string) {
+		if !failed[source] {
+			next[dest] = source
+			return
+		}
+		if old, ok := m.names[dest]; ok {
+			next[dest] = old
+		}
+	}
+
+	for source, dest := range diff.DestPaths {
+		record(source, dest)
+	}
+	for _, d := range diff.Diffs {
+		switch d.Action {
+		case ActionDelete, ActionDeleteSource:
+			delete(next, d.target())
+		default:
+			if d.DestPath != "" {
+				record(d.Path, d.DestPath)
+			}
+		}
+	}
+
+	m.names = next
+}
+
+// exactNames reports whether the differ matches paths byte for byte, so
+// entries can be paired in walk order without a lookup by name key.
+func (d *Differ) exactNames() bool {
+	return d.Normalization == fs.NormalizeNone && !d.FoldCase && !d.Sanitize && d.MaxNameLength == 0
+}
+
+// key returns the name key under which a source path is matched with the
+// other side.
+func (d *Differ) key(path string) string {
+	if d.exactNames() {
+		return path
+	}
+	return fs.NameKey(path, d.Normalization, d.FoldCase)
+}
+
+// destKey returns the name key of a destination path: that of the source
+// path it was named after, when known.
+func (d *Differ) destKey(path string) string {
+	if source, ok := d.knownSource(path); ok {
+		return d.key(source)
+	}
+	return d.key(path)
+}
+
+// knownSource returns the source path the destination path was named
+// after by an earlier run.
+func (d *Differ) knownSource(path string) (string, bool) {
+	if d.Names == nil {
+		return "", false
+	}
+	return d.Names.Source(path)
+}
+
+// destName returns the name a new destination entry is given for the
+// source name base.
+func (d *Differ) destName(base string) (string, error) {
+	name := d.Normalization.Apply(base)
+	if d.Sanitize {
+		var err error
+		if name, err = fs.SanitizeName(name); err != nil {
+			return "", err
+		}
+	}
+	if d.MaxNameLength > 0 && len(name) > d.MaxNameLength {
+		return "", &fs.NameError{Name: base, Reason: "name too long"}
+	}
+	return name, nil
+}
+
+// sourceMap indexes the source entries by name key. When several share a
+// key the first one walked is kept, and the others, along with whatever is
+// below them, are returned as skipped.
+func (d *Differ) sourceMap(source []fs.FileInfo) (map[string]fs.FileInfo, map[string]error) {
+	sourceMap := make(map[string]fs.FileInfo, len(source))
+	if d.exactNames() {
+		for _, f := range source {
+			sourceMap[f.Path] = f
+		}
+		return sourceMap, nil
+	}
+
+	skipped := make(map[string]error)
+	var skippedDirs []string // their entries are left out silently
+	for _, f := range source {
+		if n := len(skippedDirs); n > 0 && isBelow(f.Path, skippedDirs[n-1]) {
+			continue
+		}
+		key := d.key(f.Path)
+		if kept, ok := sourceMap[key]; ok {
+			skipped[f.Path] = &NameCollisionError{Other: kept.Path}
+			if f.IsDir {
+				skippedDirs = append(skippedDirs, f.Path)
+			}
+			continue
+		}
+		sourceMap[key] = f
+	}
+	return sourceMap, skipped
+}
+
+// destMap indexes the destination entries by name key. When several share
+// a key, the one named exactly like its source path is kept, or else the
+// first one walked. The others are returned as extras.
+func (d *Differ) destMap(dest []fs.FileInfo, sourceMap map[string]fs.FileInfo) (map[string]fs.FileInfo, []fs.FileInfo) {
+	destMap := make(map[string]fs.FileInfo, len(dest))
+	var extra []fs.FileInfo
+	for _, f := range dest {
+		key := d.destKey(f.Path)
+		kept, ok := destMap[key]
+		switch {
+		case !ok:
+			destMap[key] = f
+		case f.Path == sourceMap[key].Path && kept.Path != f.Path:
+			destMap[key] = f
+			extra = append(extra, kept)
+		default:
+			extra = append(extra, f)
+		}
+	}
+	return destMap, extra
+}
+
+// destPaths names the source entries whose destination path differs from
+// their own. Entries whose name cannot be stored at the destination, or
+// would be taken by another entry there, are moved from sourceMap to
+// skipped along with whatever is below them.
+func (d *Differ) destPaths(sourceMap, destMap map[string]fs.FileInfo, skipped map[string]error) map[string]string {
+	if d.exactNames() {
+		return nil
+	}
+
+	// The path each name at the destination belongs to, by its name key
+	// there
+	owners := make(map[string]string, len(destMap))
+	for key, f := range destMap {
+		owner := f.Path
+		if source, ok := sourceMap[key]; ok {
+			owner = source.Path
+		}
+		owners[d.key(f.Path)] = owner
+	}
+
+	sorted := make([]fs.FileInfo, 0, len(sourceMap))
+	for _, f := range sourceMap {
+		sorted = append(sorted, f)
+	}
+	sort.Slice(sorted, func(a, b int) bool {
+		return fs.ComparePaths(sorted[a].Path, sorted[b].Path) < 0
+	})
+
+	name := d.namer(destMap, d.key, d.destName)
+	paths := make(map[string]string)
+	var skippedDirs []string
+	for _, f := range sorted {
+		key := d.key(f.Path)
+		if n := len(skippedDirs); n > 0 && isBelow(f.Path, skippedDirs[n-1]) {
+			delete(sourceMap, key)
+			continue
+		}
+
+		n, err := name(f.Path)
+		if _, exists := destMap[key]; err == nil && !exists {
+			if owner, taken := owners[d.key(n)]; taken {
+				err = &NameCollisionError{Other: owner}
+			} else {
+				owners[d.key(n)] = f.Path
+			}
+		}
+		if err != nil {
+			skipped[f.Path] = err
+			delete(sourceMap, key)
+			if f.IsDir {
+				skippedDirs = append(skippedDirs, f.Path)
+			}
+			continue
+		}
+
+		if n != f.Path {
+			paths[f.Path] = n
+		}
+	}
+	return paths
+}
+
+// namer returns a function that names paths of the other side on the side
+// whose entries are in existing, indexed by keyOf. A path with an entry
+// there keeps the name of that entry, and a new one goes into the name its
+// parent directory has there, under its base name as given by newName.
+func (d *Differ) namer(existing map[string]fs.FileInfo, keyOf func(string) string, newName func(string) (string, error)) func(string) (string, error) {
+	names := make(map[string]string)
+	var name func(path string) (string, error)
+	name = func(path string) (string, error) {
+		if n, ok := names[path]; ok {
+			return n, nil
+		}
+		if f, ok := existing[keyOf(path)]; ok {
+			names[path] = f.Path
+			return f.Path, nil
+		}
+
+		n, err := newName(filepath.Base(path))
+		if err != nil {
+			return "", err
+		}
+		if dir := filepath.Dir(path); dir != "." {
+			parent, err := name(dir)
+			if err != nil {
+				return "", err
+			}
+			n = filepath.Join(parent, n)
+		}
+		names[path] = n
+		return n, nil
+	}
+	return name
+}
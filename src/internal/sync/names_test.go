@@ -0,0 +1,258 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"excellgene.com/mirrorBox/internal/sync/fs"
+)
+
+const (
+	cafeNFC = "Caf\u00e9"
+	cafeNFD = "Cafe\u0301"
+)
+
+func TestDiffNames(t *testing.T) {
+	tests := []struct {
+		name           string
+		normalization  fs.Normalization
+		foldCase       bool
+		sanitize       bool
+		names          map[string]string // destination path -> source path
+		source         []fs.FileInfo
+		dest           []fs.FileInfo
+		want           map[string]Action
+		wantDest       map[string]string // DestPath of diffs that have one
+		wantCollided   map[string]string
+		wantUnstorable []string
+	}{
+		{
+			name:   "other unicode form not matched",
+			source: []fs.FileInfo{testFile(cafeNFC, 1, 100)},
+			dest:   []fs.FileInfo{testFile(cafeNFD, 1, 100)},
+			want:   map[string]Action{cafeNFC: ActionCreate, cafeNFD: ActionDelete},
+		},
+		{
+			name:          "other unicode form matched",
+			normalization: fs.NormalizeNFC,
+			source:        []fs.FileInfo{testFile(cafeNFC, 1, 100)},
+			dest:          []fs.FileInfo{testFile(cafeNFD, 1, 100)},
+			want:          map[string]Action{},
+		},
+		{
+			name:          "update keeps the destination name",
+			normalization: fs.NormalizeNFC,
+			source:        []fs.FileInfo{testFile(cafeNFC, 2, 200)},
+			dest:          []fs.FileInfo{testFile(cafeNFD, 1, 100)},
+			want:          map[string]Action{cafeNFC: ActionUpdate},
+			wantDest:      map[string]string{cafeNFC: cafeNFD},
+		},
+		{
+			name:          "new file goes into the existing directory",
+			normalization: fs.NormalizeNFD,
+			source:        []fs.FileInfo{testDir(cafeNFC), testFile(filepath.Join(cafeNFC, cafeNFC), 1, 100)},
+			dest:          []fs.FileInfo{testDir(cafeNFD)},
+			want:          map[string]Action{filepath.Join(cafeNFC, cafeNFC): ActionCreate},
+			wantDest:      map[string]string{filepath.Join(cafeNFC, cafeNFC): filepath.Join(cafeNFD, cafeNFD)},
+		},
+		{
+			name:     "case collision",
+			foldCase: true,
+			source:   []fs.FileInfo{testFile("README", 1, 100), testFile("readme", 2, 100)},
+			want:     map[string]Action{"README": ActionCreate},
+			wantCollided: map[string]string{
+				"readme": "README",
+			},
+		},
+		{
+			name:     "case collision of a directory",
+			foldCase: true,
+			source: []fs.FileInfo{
+				testDir("Docs"), testFile(filepath.Join("Docs", "a"), 1, 100),
+				testDir("docs"), testFile(filepath.Join("docs", "b"), 1, 100),
+			},
+			want: map[string]Action{"Docs": ActionCreate, filepath.Join("Docs", "a"): ActionCreate},
+			wantCollided: map[string]string{
+				"docs": "Docs",
+			},
+		},
+		{
+			name:     "case difference matched",
+			foldCase: true,
+			source:   []fs.FileInfo{testFile("README", 1, 100)},
+			dest:     []fs.FileInfo{testFile("readme", 1, 100)},
+			want:     map[string]Action{},
+		},
+		{
+			name:     "exact name preferred",
+			foldCase: true,
+			source:   []fs.FileInfo{testFile("README", 1, 100)},
+			dest:     []fs.FileInfo{testFile("readme", 1, 100), testFile("README", 1, 100)},
+			want:     map[string]Action{"readme": ActionDelete},
+		},
+		{
+			name:     "sanitized names",
+			sanitize: true,
+			source: []fs.FileInfo{
+				testDir("a:b"), testFile(filepath.Join("a:b", "CON.txt"), 1, 100),
+				testFile("plain", 1, 100),
+			},
+			want: map[string]Action{
+				"a:b":                           ActionCreate,
+				filepath.Join("a:b", "CON.txt"): ActionCreate,
+				"plain":                         ActionCreate,
+			},
+			wantDest: map[string]string{
+				"a:b":                           "a\uF022b",
+				filepath.Join("a:b", "CON.txt"): filepath.Join("a\uF022b", "CO\uF04E.txt"),
+			},
+		},
+		{
+			name:     "sanitized name matched through the name map",
+			sanitize: true,
+			names:    map[string]string{"a\uF022b": "a:b"},
+			source:   []fs.FileInfo{testFile("a:b", 1, 100), testFile("a\uF022b", 1, 100)},
+			dest:     []fs.FileInfo{testFile("a\uF022b", 1, 100)},
+			want:     map[string]Action{},
+			wantCollided: map[string]string{
+				"a\uF022b": "a:b",
+			},
+		},
+		{
+			name:           "unstorable name",
+			sanitize:       true,
+			source:         []fs.FileInfo{testDir("bad\xff"), testFile(filepath.Join("bad\xff", "x"), 1, 100)},
+			want:           map[string]Action{},
+			wantUnstorable: []string{"bad\xff"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDiffer()
+			d.DeleteExtraFiles = true
+			d.Normalization = tt.normalization
+			d.FoldCase = tt.foldCase
+			d.Sanitize = tt.sanitize
+			if tt.names != nil {
+				d.Names = &NameMap{names: tt.names}
+			}
+
+			result := d.Diff(tt.source, tt.dest)
+
+			got := make(map[string]Action)
+			for _, diff := range result.Diffs {
+				got[diff.Path] = diff.Action
+				if diff.DestPath != tt.wantDest[diff.Path] {
+					t.Errorf("%q: destination path %q, want %q", diff.Path, diff.DestPath, tt.wantDest[diff.Path])
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for path, action := range tt.want {
+				if got[path] != action {
+					t.Errorf("%q: got %v, want %v", path, got[path], action)
+				}
+			}
+
+			if len(result.Skipped) != len(tt.wantCollided)+len(tt.wantUnstorable) {
+				t.Fatalf("skipped %v, want collisions %v and unstorable %q", result.Skipped, tt.wantCollided, tt.wantUnstorable)
+			}
+			for path, other := range tt.wantCollided {
+				var collision *NameCollisionError
+				if !errors.As(result.Skipped[path], &collision) || collision.Other != other {
+					t.Errorf("%q: skipped for %v, want collision with %q", path, result.Skipped[path], other)
+				}
+			}
+			for _, path := range tt.wantUnstorable {
+				var nameErr *fs.NameError
+				if !errors.As(result.Skipped[path], &nameErr) {
+					t.Errorf("%q: skipped for %v, want a name error", path, result.Skipped[path])
+				}
+			}
+		})
+	}
+}
+
+func TestRunNormalizedNames(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	if err := os.Mkdir(filepath.Join(src, cafeNFC), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"README", "readme"} {
+		if err := os.WriteFile(filepath.Join(src, cafeNFC, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	job := NewJob("test", src, dst, Options{
+		DeleteExtraFiles: true,
+		Normalization:    fs.NormalizeNFD,
+		CaseInsensitive:  true,
+	})
+	result, err := job.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var collision *NameCollisionError
+	if len(result.Errors) != 1 || !errors.As(result.Errors[0], &collision) {
+		t.Fatalf("errors %v, want one name collision", result.Errors)
+	}
+	if _, err := os.Stat(filepath.Join(dst, cafeNFD, "README")); err != nil {
+		t.Errorf("not copied under the NFD name: %v", err)
+	}
+
+	// The second run finds the NFD copy in place
+	result, err = job.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FilesCreated != 0 || result.FilesDeleted != 0 {
+		t.Errorf("second run created %d and deleted %d, want nothing", result.FilesCreated, result.FilesDeleted)
+	}
+}
+
+func TestRunSanitizedNames(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	if err := os.Mkdir(filepath.Join(src, "a:b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join("a:b", "CON.txt"), "why?"} {
+		if err := os.WriteFile(filepath.Join(src, path), []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	job := NewJob("test", src, dst, Options{DeleteExtraFiles: true, SanitizeNames: true})
+	result, err := job.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FilesCreated != 3 || len(result.Errors) != 0 {
+		t.Fatalf("created %d with errors %v, want 3 without errors", result.FilesCreated, result.Errors)
+	}
+	for _, path := range []string{filepath.Join("a\uF022b", "CO\uF04E.txt"), "why\uF025"} {
+		if _, err := os.Stat(filepath.Join(dst, path)); err != nil {
+			t.Errorf("not copied under the sanitized name: %v", err)
+		}
+	}
+
+	// A file named like a sanitized one is not mistaken for it
+	if err := os.WriteFile(filepath.Join(src, "why\uF025"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err = job.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var collision *NameCollisionError
+	if result.FilesCreated != 0 || result.FilesDeleted != 0 || len(result.Errors) != 1 || !errors.As(result.Errors[0], &collision) {
+		t.Errorf("second run created %d and deleted %d with errors %v, want only a name collision",
+			result.FilesCreated, result.FilesDeleted, result.Errors)
+	}
+}
@@ -0,0 +1,55 @@
+package sync
+
+import (
+	"log"
+	"path/filepath"
+
+	"excellgene.com/mirrorBox/internal/sync/fs"
+)
+
+// partialLister is implemented by walkers that note the partial transfer
+// files they skip.
+type partialLister interface {
+	Partials() []string
+}
+
+// walkedPartials returns the partial files w came across in its last walk.
+func walkedPartials(w fs.Walker) []string {
+	if l, ok := w.(partialLister); ok {
+		return append([]string(nil), l.Partials()...)
+	}
+	return nil
+}
+
+// markPartials adds the partial file and checkpoint a transfer of d could
+// resume from to inUse. Only files large enough for a resumable copy have
+// them, which keeps the set small.
+func markPartials(inUse map[string]bool, d FileDiff, sourcePath, destPath string) {
+	large := func(f *fs.FileInfo) bool {
+		return f != nil && !f.IsDir && !f.IsSymlink && f.Size >= resumeMinSize
+	}
+	if !large(d.Source) && !large(d.Dest) {
+		return
+	}
+
+	for _, path := range []string{filepath.Join(sourcePath, d.Path), filepath.Join(destPath, d.target())} {
+		partial, checkpoint := fs.PartialPaths(path)
+		inUse[partial] = true
+		inUse[checkpoint] = true
+	}
+}
+
+// removeStalePartials deletes the partial files found during the run that
+// no diff of it could resume from. They belong to transfers of files that
+// have since been deleted, changed or copied some other way, and would
+// otherwise stay hidden from every later run.
+func (j *Job) removeStalePartials(partials []string, inUse map[string]bool) {
+	for _, path := range partials {
+		if inUse[path] {
+			continue
+		}
+		if err := fs.RemovePartial(path); err != nil {
+			log.Printf("Job %s: remove stale partial %s: %v", j.Name, path, err)
+		}
+	}
+}
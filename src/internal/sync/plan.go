@@ -0,0 +1,126 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"excellgene.com/mirrorBox/internal/sync/fs"
+)
+
+// Plan is what a run would do, computed without changing either side.
+// Pass it to Job.Apply to carry it out.
+type Plan struct {
+	Diff   *DiffResult
+	Totals map[Action]PlanTotal
+
+	// Blocked is set when applying the plan would exceed the job's deletion
+	// safety limit. Apply refuses such plans.
+	Blocked error
+
+	job         *Job
+	sourceFiles []fs.FileInfo
+	destFiles   []fs.FileInfo
+	partials    []string
+}
+
+// PlanTotal counts the entries and bytes of one kind of action.
+type PlanTotal struct {
+	Count int
+	Bytes int64
+}
+
+// Size returns the number of bytes the diff moves or removes.
+func (d FileDiff) Size() int64 {
+	var f *fs.FileInfo
+	switch d.Action {
+	case ActionCreate, ActionUpdate, ActionConflict, ActionDeleteSource:
+		f = d.Source
+	case ActionCreateSource, ActionUpdateSource, ActionDelete:
+		f = d.Dest
+	}
+	if f == nil || f.IsDir {
+		return 0
+	}
+	return f.Size
+}
+
+// Plan walks both sides and computes the changes a run would make, without
+// applying them. It does not change the job's status.
+func (j *Job) Plan(ctx context.Context) (*Plan, error) {
+	if !j.busy.TryLock() {
+		return nil, ErrJobRunning
+	}
+	defer j.busy.Unlock()
+
+	return j.plan(ctx)
+}
+
+func (j *Job) plan(ctx context.Context) (*Plan, error) {
+	if j.checksums != nil {
+		if err := j.checksums.Load(); err != nil {
+			log.Printf("Job %s: %v", j.Name, err)
+		}
+	}
+
+	j.probeDestination()
+	j.loadIndexes()
+
+	var sourceFiles []fs.FileInfo
+	err := j.sourceWalker.Walk(func(info fs.FileInfo) error {
+		sourceFiles = append(sourceFiles, info)
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk source: %w", err)
+	}
+
+	var destFiles []fs.FileInfo
+	if j.destWalker != nil {
+		err = j.destWalker.Walk(func(info fs.FileInfo) error {
+			destFiles = append(destFiles, info)
+			return ctx.Err()
+		})
+		if err != nil {
+			return nil, fmt.Errorf("walk destination: %w", err)
+		}
+	}
+	j.saveIndexes()
+	j.destCount = len(destFiles)
+
+	if err := j.loadNames(); err != nil {
+		return nil, err
+	}
+
+	var diffResult *DiffResult
+	if j.Options.TwoWay {
+		if err := j.loadState(); err != nil {
+			return nil, err
+		}
+		diffResult = j.differ.DiffTwoWay(sourceFiles, destFiles, j.state)
+	} else {
+		j.dropState()
+		if err := j.loadInodes(); err != nil {
+			return nil, err
+		}
+		diffResult = j.differ.Diff(sourceFiles, destFiles)
+	}
+
+	plan := &Plan{
+		Diff:        diffResult,
+		Totals:      make(map[Action]PlanTotal),
+		Blocked:     j.checkDeleteLimit(diffResult, len(sourceFiles), len(destFiles)),
+		job:         j,
+		sourceFiles: sourceFiles,
+		destFiles:   destFiles,
+		partials:    append(walkedPartials(j.sourceWalker), walkedPartials(j.destWalker)...),
+	}
+	for _, d := range diffResult.Diffs {
+		total := plan.Totals[d.Action]
+		total.Count++
+		total.Bytes += d.Size()
+		plan.Totals[d.Action] = total
+	}
+
+	return plan, nil
+}
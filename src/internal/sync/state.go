@@ -0,0 +1,202 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"excellgene.com/mirrorBox/internal/sync/fs"
+)
+
+// fileState is the part of a file's metadata remembered between runs.
+type fileState struct {
+	Size       int64  `json:"size"`
+	ModTime    int64  `json:"mtime"`
+	IsDir      bool   `json:"dir,omitempty"`
+	LinkTarget string `json:"link,omitempty"`
+}
+
+func newFileState(f fs.FileInfo) fileState {
+	return fileState{Size: f.Size, ModTime: f.ModTime, IsDir: f.IsDir, LinkTarget: f.LinkTarget}
+}
+
+// changedSince reports whether f differs from the remembered state, with
+// modification times compared by sameTime. Directories only change when
+// they turn into a file, and symlinks when their target changes.
+func (s fileState) changedSince(f fs.FileInfo, sameTime func(a, b int64) bool) bool {
+	if s.IsDir != f.IsDir {
+		return true
+	}
+	if s.LinkTarget != "" || f.IsSymlink {
+		return s.LinkTarget != f.LinkTarget
+	}
+	if f.IsDir {
+		return false
+	}
+	return s.Size != f.Size || !sameTime(s.ModTime, f.ModTime)
+}
+
+// exactTime compares modification times of a side that stores them as
+// given.
+func exactTime(a, b int64) bool {
+	return a == b
+}
+
+// written returns the state of the entry a run wrote at path below root,
+// read back because it can differ from the entry it was copied from: link
+// targets may have been rewritten, and coarse filesystems round times. The
+// state of from is returned when the entry cannot be read.
+func written(root, path string, from fs.FileInfo) fileState {
+	if root == "" {
+		return newFileState(from)
+	}
+	full := filepath.Join(root, path)
+	info, err := os.Lstat(full)
+	if err != nil {
+		return newFileState(from)
+	}
+
+	state := fileState{Size: info.Size(), ModTime: info.ModTime().Unix(), IsDir: info.IsDir()}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if state.LinkTarget, err = os.Readlink(full); err != nil {
+			return newFileState(from)
+		}
+	}
+	return state
+}
+
+// stateEntry records both sides of a path as they were after the last
+// successful sync.
+type stateEntry struct {
+	Source fileState `json:"source"`
+	Dest   fileState `json:"dest"`
+}
+
+// SyncState is the last-synced snapshot of both sides of a two-way job.
+type SyncState struct {
+	path    string
+	entries map[string]stateEntry
+}
+
+// LoadSyncState reads the snapshot stored at path. A missing file yields an
+// empty state, as does an empty path (in-memory only).
+func LoadSyncState(path string) (*SyncState, error) {
+	state := &SyncState{
+		path:    path,
+		entries: make(map[string]stateEntry),
+	}
+
+	if path == "" {
+		return state, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("read sync state: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &state.entries); err != nil {
+		return nil, fmt.Errorf("parse sync state: %w", err)
+	}
+
+	return state, nil
+}
+
+// Save writes the snapshot to disk.
+func (s *SyncState) Save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return fmt.Errorf("marshal sync state: %w", err)
+	}
+
+	if err := fs.WriteStateFile(s.path, data); err != nil {
+		return fmt.Errorf("write sync state: %w", err)
+	}
+
+	return nil
+}
+
+// Update replaces the snapshot with the state both sides are in after
+// applying diff. Paths that failed keep their previous entry, so the change
+// is detected again on the next run. Entries are stored under the name key
+// differ matched their paths by.
+func (s *SyncState) Update(source, dest []fs.FileInfo, diff *DiffResult, failed map[string]bool, differ *Differ) {
+	actions := make(map[string]FileDiff, len(diff.Diffs))
+	for _, d := range diff.Diffs {
+		actions[differ.key(d.Path)] = d
+	}
+	failedKeys := make(map[string]bool, len(failed))
+	for path := range failed {
+		failedKeys[differ.key(path)] = true
+	}
+
+	next := make(map[string]stateEntry, len(s.entries))
+
+	keep := func(k string) {
+		if entry, ok := s.entries[k]; ok {
+			next[k] = entry
+		}
+	}
+
+	// Entries left out of the diff for sharing the name of another are
+	// left out here too
+	destMap := make(map[string]fs.FileInfo, len(dest))
+	for _, f := range dest {
+		if _, skipped := diff.Skipped[f.Path]; !skipped {
+			destMap[differ.destKey(f.Path)] = f
+		}
+	}
+
+	seen := make(map[string]bool, len(source))
+	for _, src := range source {
+		k := differ.key(src.Path)
+		if _, skipped := diff.Skipped[src.Path]; skipped || seen[k] {
+			continue
+		}
+		seen[k] = true
+		d, ok := actions[k]
+		switch {
+		case failedKeys[k]:
+			keep(k)
+		case !ok:
+			if dst, exists := destMap[k]; exists {
+				next[k] = stateEntry{Source: newFileState(src), Dest: newFileState(dst)}
+			}
+		case d.Action == ActionCreate || d.Action == ActionUpdate:
+			next[k] = stateEntry{Source: newFileState(src), Dest: written(differ.DestRoot, d.target(), src)}
+		case d.Action == ActionConflict:
+			keep(k)
+		}
+	}
+
+	for _, dst := range dest {
+		k := differ.destKey(dst.Path)
+		if destMap[k].Path != dst.Path {
+			continue
+		}
+		if failedKeys[k] {
+			keep(k)
+			continue
+		}
+		d, ok := actions[k]
+		if !ok {
+			continue
+		}
+		switch d.Action {
+		case ActionCreateSource, ActionUpdateSource:
+			next[k] = stateEntry{Source: written(differ.SourceRoot, d.Path, dst), Dest: newFileState(dst)}
+		case ActionConflict:
+			keep(k)
+		}
+	}
+
+	s.entries = next
+}
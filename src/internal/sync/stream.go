@@ -0,0 +1,294 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+
+	"excellgene.com/mirrorBox/internal/sync/fs"
+)
+
+// streamBuffer bounds the entries queued between the walkers, the differ
+// and the syncer of a streaming run, so no listing is ever held whole.
+const streamBuffer = 1024
+
+// DiffStream compares two walks that report paths in fs.ComparePaths order
+// and calls emit for each difference as soon as it is found. It holds one
+// entry per side at a time. Unlike Diff it reports no hard links or moves.
+func (d *Differ) DiffStream(source, dest <-chan fs.FileInfo, emit func(FileDiff) error) error {
+	srcFile, srcOK := <-source
+	destFile, destOK := <-dest
+
+	for srcOK || destOK {
+		var order int
+		switch {
+		case !destOK:
+			order = -1
+		case !srcOK:
+			order = 1
+		default:
+			order = fs.ComparePaths(srcFile.Path, destFile.Path)
+		}
+
+		// Copies, so the emitted diff keeps its own entries
+		src, dst := srcFile, destFile
+
+		var diff FileDiff
+		switch {
+		case order < 0:
+			diff = FileDiff{Path: src.Path, Action: ActionCreate, Source: &src}
+		case order > 0:
+			if d.DeleteExtraFiles && !isConflictCopy(dst.Path) {
+				diff = FileDiff{Path: dst.Path, Action: ActionDelete, Dest: &dst}
+			}
+		default:
+			diff = FileDiff{Path: src.Path, Action: d.compare(&src, &dst), Source: &src, Dest: &dst}
+		}
+
+		// A walk out of order would make present files look missing
+		if order <= 0 {
+			srcFile, srcOK = <-source
+			if srcOK && fs.ComparePaths(srcFile.Path, src.Path) <= 0 {
+				return fmt.Errorf("source walk out of order at %s", srcFile.Path)
+			}
+		}
+		if order >= 0 {
+			destFile, destOK = <-dest
+			if destOK && fs.ComparePaths(destFile.Path, dst.Path) <= 0 {
+				return fmt.Errorf("destination walk out of order at %s", destFile.Path)
+			}
+		}
+
+		if diff.Action != ActionNone {
+			if err := emit(diff); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// SyncStream applies diffs as they arrive from a streaming diff.
+// Directories are created as they arrive, which is before their contents,
+// and files are handed to the worker pool. It returns once diffs is closed
+// and every transfer has finished, or ctx is cancelled.
+func (s *Syncer) SyncStream(ctx context.Context, diffs <-chan FileDiff, sourcePath, destPath string) (*SyncResult, error) {
+	result := &SyncResult{}
+	touched := make(dirTargets)
+
+	var mu gosync.Mutex
+	apply := func(fileDiff FileDiff) {
+		stats, err := s.apply(ctx, fileDiff, sourcePath, destPath)
+
+		mu.Lock()
+		defer mu.Unlock()
+		result.record(fileDiff, stats, err)
+		if err == nil {
+			s.recordDigest(fileDiff, destPath)
+		}
+	}
+
+	work := make(chan FileDiff)
+	var wg gosync.WaitGroup
+	for i := 0; i < s.workers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fileDiff := range work {
+				apply(fileDiff)
+			}
+		}()
+	}
+
+feed:
+	for fileDiff := range diffs {
+		if ctx.Err() != nil {
+			break
+		}
+
+		touched.add(fileDiff, sourcePath, destPath)
+		if createsDir(fileDiff) {
+			apply(fileDiff)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			break feed
+		case work <- fileDiff:
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+
+	s.applyDirMetadata(touched, destPath, result)
+
+	return result, nil
+}
+
+// runStreaming is Run for jobs with Options.Streaming. Both trees are
+// walked concurrently and merged as they are read, and copying starts with
+// the first difference found. Deletions wait until both walks are complete
+// and are skipped when they exceed the safety limit.
+func (j *Job) runStreaming(ctx context.Context) (*SyncResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	j.dropState()
+	if j.checksums != nil {
+		if err := j.checksums.Load(); err != nil {
+			log.Printf("Job %s: %v", j.Name, err)
+		}
+	}
+	j.loadIndexes()
+
+	sourceCh := make(chan fs.FileInfo, streamBuffer)
+	destCh := make(chan fs.FileInfo, streamBuffer)
+	var sourceErr, destErr error
+	var destCount int
+
+	// The destination walk never sees this run's writes: a diff is only
+	// emitted once the walk has reached its path, and a directory is listed
+	// when the walk enters it, so everything later written there sorts
+	// before the walk's position.
+	//
+	// A failed walk cancels the run before closing its channel, so the
+	// differ never mistakes the rest of a truncated listing for missing
+	// entries.
+	var walkers gosync.WaitGroup
+	walkers.Add(2)
+	go func() {
+		defer walkers.Done()
+		defer close(sourceCh)
+		_, sourceErr = walkInto(ctx, j.sourceWalker, sourceCh)
+		if sourceErr != nil {
+			cancel()
+		}
+	}()
+	go func() {
+		defer walkers.Done()
+		defer close(destCh)
+		if j.destWalker != nil {
+			destCount, destErr = walkInto(ctx, j.destWalker, destCh)
+		}
+		if destErr != nil {
+			cancel()
+		}
+	}()
+
+	// Deletions are held back; the contents of a deleted directory go with
+	// it, so only the topmost path is kept.
+	diffs := make(chan FileDiff, streamBuffer)
+	inUse := make(map[string]bool)
+	var deletes []FileDiff
+	var destDeletes int
+	var diffErr error
+	diffDone := make(chan struct{})
+	go func() {
+		defer close(diffDone)
+		defer close(diffs)
+		diffErr = j.differ.DiffStream(sourceCh, destCh, func(d FileDiff) error {
+			// Checked first: once a walk has failed, the diff is unreliable
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if d.Action == ActionDelete {
+				destDeletes++
+				if n := len(deletes); n == 0 || !isBelow(d.Path, deletes[n-1].Path) {
+					deletes = append(deletes, d)
+				}
+				return nil
+			}
+			markPartials(inUse, d, j.SourcePath, j.DestinationPath)
+			select {
+			case diffs <- d:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if diffErr != nil {
+			cancel() // release the walkers
+		}
+	}()
+
+	result, err := j.syncer.SyncStream(ctx, diffs, j.SourcePath, j.DestinationPath)
+	<-diffDone
+	walkers.Wait()
+	if sourceErr == nil && destErr == nil {
+		j.saveIndexes()
+		j.destCount = destCount
+	}
+
+	// A walk that failed by itself is the cause of any cancellation
+	switch {
+	case sourceErr != nil && !isCancel(sourceErr):
+		err = fmt.Errorf("walk source: %w", sourceErr)
+	case destErr != nil && !isCancel(destErr):
+		err = fmt.Errorf("walk destination: %w", destErr)
+	case diffErr != nil:
+		err = diffErr
+	case err != nil:
+	case sourceErr != nil:
+		err = fmt.Errorf("walk source: %w", sourceErr)
+	case destErr != nil:
+		err = fmt.Errorf("walk destination: %w", destErr)
+	default:
+		err = j.deleteLimit("destination", destDeletes, destCount)
+	}
+
+	if err == nil && len(deletes) > 0 {
+		var deleted *SyncResult
+		deleted, err = j.syncer.Sync(ctx, &DiffResult{Diffs: deletes}, j.SourcePath, j.DestinationPath)
+		result.merge(deleted)
+	}
+
+	if err == nil {
+		j.removeStalePartials(append(walkedPartials(j.sourceWalker), walkedPartials(j.destWalker)...), inUse)
+	}
+
+	// Pruning entries for removed files would need both listings in memory
+	if j.checksums != nil {
+		if err := j.checksums.Save(); err != nil {
+			log.Printf("Job %s: %v", j.Name, err)
+		}
+	}
+	j.pruneVersions()
+
+	return j.finish(result, err)
+}
+
+// walkInto sends every entry the walker reports to ch and returns how many
+// there were. It gives up when ctx is cancelled.
+func walkInto(ctx context.Context, w fs.Walker, ch chan<- fs.FileInfo) (int, error) {
+	count := 0
+	err := w.Walk(func(info fs.FileInfo) error {
+		select {
+		case ch <- info:
+			count++
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	return count, err
+}
+
+// isCancel reports whether err is only the result of a cancelled context.
+func isCancel(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// isBelow reports whether path lies inside dir.
+func isBelow(path, dir string) bool {
+	return strings.HasPrefix(path, dir+string(filepath.Separator))
+}
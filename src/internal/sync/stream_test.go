@@ -0,0 +1,72 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"excellgene.com/mirrorBox/internal/sync/fs"
+)
+
+// failAfterWalker reports the first n entries of a walk, then fails.
+type failAfterWalker struct {
+	fs.Walker
+	n int
+}
+
+func (w failAfterWalker) Walk(fn func(fs.FileInfo) error) error {
+	seen := 0
+	return w.Walker.Walk(func(info fs.FileInfo) error {
+		if seen == w.n {
+			return errors.New("device went away")
+		}
+		seen++
+		return fn(info)
+	})
+}
+
+func TestStreamingStopsOnWalkError(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	old := time.Unix(1000, 0)
+	names := []string{"a", "b", "c", "d", "e"}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(src, name), []byte("source"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(src, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dst, name), []byte("newer destination"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, side := range []string{"source", "destination"} {
+		t.Run(side, func(t *testing.T) {
+			job := NewJob("test", src, dst, Options{Streaming: true, Conflicts: ConflictSkip, DeleteExtraFiles: true})
+			if side == "source" {
+				job.sourceWalker = failAfterWalker{job.sourceWalker, 1}
+			} else {
+				job.destWalker = failAfterWalker{job.destWalker, 1}
+			}
+
+			result, err := job.Run(context.Background())
+			if err == nil || !strings.Contains(err.Error(), "walk "+side) {
+				t.Fatalf("got error %v, want a %s walk error", err, side)
+			}
+			if result.FilesCreated != 0 || result.FilesDeleted != 0 {
+				t.Errorf("created %d and deleted %d files from a partial listing", result.FilesCreated, result.FilesDeleted)
+			}
+			for _, name := range names {
+				data, err := os.ReadFile(filepath.Join(dst, name))
+				if err != nil || string(data) != "newer destination" {
+					t.Errorf("%s: got %q, %v", name, data, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"excellgene.com/mirrorBox/internal/sync/fs"
+)
+
+// rewriteLinkTarget maps an absolute link target inside fromRoot to the same
+// location below toRoot. Relative targets and targets outside fromRoot are
+// returned unchanged.
+func rewriteLinkTarget(target, fromRoot, toRoot string) string {
+	if !filepath.IsAbs(target) {
+		return target
+	}
+
+	rel, err := filepath.Rel(fromRoot, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return target
+	}
+
+	return filepath.Join(toRoot, rel)
+}
+
+// linkChanged reports whether the destination no longer matches a source
+// entry when at least one of them is a symlink.
+func (d *Differ) linkChanged(source, dest *fs.FileInfo) bool {
+	if !source.IsSymlink || !dest.IsSymlink {
+		return true
+	}
+
+	target := source.LinkTarget
+	if d.RewriteLinks {
+		target = rewriteLinkTarget(target, d.SourceRoot, d.DestRoot)
+	}
+
+	return target != dest.LinkTarget
+}
+
+// createSymlink recreates the source link at the destination, replacing
+// whatever file or link is there.
+func (s *Syncer) createSymlink(diff FileDiff, sourcePath, destPath string) error {
+	dstPath := filepath.Join(destPath, diff.target())
+
+	target := diff.Source.LinkTarget
+	if s.rewriteLinks {
+		target = rewriteLinkTarget(target, sourcePath, destPath)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return fmt.Errorf("create parent directories: %w", err)
+	}
+
+	if info, err := os.Lstat(dstPath); err == nil && info.IsDir() {
+		return fmt.Errorf("cannot replace directory with symlink")
+	}
+
+	// Link under a temporary name, then rename over the old entry, so the
+	// path is never missing
+	tmpPath := filepath.Join(filepath.Dir(dstPath), ".mirrorbox-tmp-link-"+filepath.Base(dstPath))
+	os.Remove(tmpPath)
+	if err := os.Symlink(target, tmpPath); err != nil {
+		return fmt.Errorf("create symlink: %w", err)
+	}
+	if err := os.Rename(tmpPath, dstPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("rename symlink: %w", err)
+	}
+
+	return nil
+}
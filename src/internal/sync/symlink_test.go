@@ -0,0 +1,68 @@
+package sync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"excellgene.com/mirrorBox/internal/sync/fs"
+)
+
+func TestSyncReplaceSymlink(t *testing.T) {
+	tests := []struct {
+		name    string
+		old     func(path string) error // what the destination holds beforehand
+		action  Action
+		wantErr bool
+	}{
+		{"nothing", func(string) error { return nil }, ActionCreate, false},
+		{"file", func(path string) error { return os.WriteFile(path, []byte("old"), 0644) }, ActionUpdate, false},
+		{"link", func(path string) error { return os.Symlink("old", path) }, ActionUpdate, false},
+		{"directory", func(path string) error { return os.Mkdir(path, 0755) }, ActionUpdate, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := t.TempDir(), t.TempDir()
+			if err := tt.old(filepath.Join(dst, "l")); err != nil {
+				t.Fatal(err)
+			}
+
+			source := fs.FileInfo{Path: "l", IsSymlink: true, LinkTarget: "x"}
+			diff := &DiffResult{Diffs: []FileDiff{{Path: "l", Action: tt.action, Source: &source}}}
+
+			result, err := NewSyncer(fs.NewLocalCopier(true)).Sync(context.Background(), diff, src, dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			entries, err := os.ReadDir(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				if strings.HasPrefix(entry.Name(), ".mirrorbox-tmp-") {
+					t.Errorf("temporary %s left behind", entry.Name())
+				}
+			}
+
+			if tt.wantErr {
+				if len(result.Errors) != 1 {
+					t.Errorf("errors %v, want one", result.Errors)
+				}
+				if info, err := os.Lstat(filepath.Join(dst, "l")); err != nil || !info.IsDir() {
+					t.Errorf("directory not kept: %v", err)
+				}
+				return
+			}
+			if len(result.Errors) != 0 {
+				t.Fatalf("errors %v", result.Errors)
+			}
+			if target, err := os.Readlink(filepath.Join(dst, "l")); err != nil || target != "x" {
+				t.Errorf("link to %q, %v, want %q", target, err, "x")
+			}
+		})
+	}
+}
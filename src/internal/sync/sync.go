@@ -2,25 +2,89 @@ package sync
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	gosync "sync"
 
 	"excellgene.com/mirrorBox/internal/sync/fs"
 )
 
 type SyncResult struct {
-	FilesCreated int
-	FilesUpdated int
-	FilesDeleted int
-	BytesCopied  int64
-	Errors       []error
+	FilesCreated   int
+	FilesUpdated   int
+	FilesDeleted   int
+	FilesMoved     int   // renamed at the destination instead of copied
+	BytesCopied    int64 // logical size of the files copied
+	BytesWritten   int64 // data actually taken from the other side
+	BytesAllocated int64 // disk space taken by the copies, less than BytesCopied when holes were kept
+	Conflicts      int
+	HardLinks      int // files linked to another copy instead of copied
+	Errors         []error
+
+	// CopyMethods counts the files copied by each method.
+	CopyMethods map[fs.CopyMethod]int
+
+	// Warnings describe things that did not go as configured but did not
+	// fail the file, such as hard links copied as separate files.
+	Warnings []string
+}
+
+// FileError reports a failure to sync a single path.
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
 }
 
 type Syncer struct {
-	copier fs.Copier
+	copier    fs.Copier
+	checksums *fs.ChecksumCache
+	conflicts ConflictPolicy
+	twoWay    bool
+
+	rewriteLinks bool
+
+	// delta rebuilds large modified files from their existing copy.
+	delta bool
+
+	// concurrency is the number of files copied at once (0 = default).
+	concurrency int
+
+	// versioning keeps the old contents of replaced and deleted files.
+	versioning Versioning
+
+	// metadata selects what is copied onto directories after their
+	// contents are in place.
+	metadata fs.MetadataOptions
 }
 
+// DefaultConcurrency is the number of parallel file transfers used when a
+// job does not set its own.
+const DefaultConcurrency = 4
+
+// deltaMinSize is the smallest existing file worth a delta transfer.
+const deltaMinSize = 1024 * 1024
+
+// verifyRetries is how many times a copy that fails verification is redone
+// before the error is reported.
+const verifyRetries = 1
+
+// resumeMinSize is the smallest file copied through a resumable partial
+// file, so an interrupted transfer does not have to start over.
+const resumeMinSize = 64 * 1024 * 1024
+
 // NewSyncer creates a new syncer with a file copier.
 func NewSyncer(copier fs.Copier) *Syncer {
 	return &Syncer{
@@ -30,115 +94,487 @@ func NewSyncer(copier fs.Copier) *Syncer {
 
 // Sync applies the diff to make destination match source.
 // ctx allows cancellation of long-running operations.
+//
+// Directories are created first, in path order, so every file has its
+// parent in place. Files are then copied or moved by a pool of workers,
+// and deletions run next so nothing is removed before its replacement
+// exists or has been moved out of a deleted directory.
+// Finally, directory metadata is applied once nothing will touch the
+// directories again.
 func (s *Syncer) Sync(ctx context.Context, diff *DiffResult, sourcePath, destPath string) (*SyncResult, error) {
 	result := &SyncResult{}
 
+	skipped := make([]string, 0, len(diff.Skipped))
+	for path := range diff.Skipped {
+		skipped = append(skipped, path)
+	}
+	sort.Strings(skipped)
+	for _, path := range skipped {
+		result.Errors = append(result.Errors, &FileError{Path: path, Err: diff.Skipped[path]})
+	}
+
+	var dirs, files, links, deletes []FileDiff
+	actions := make(map[string]Action, len(diff.Diffs))
 	for _, fileDiff := range diff.Diffs {
-		// Check if context is cancelled
-		select {
-		case <-ctx.Done():
-			return result, ctx.Err()
+		actions[fileDiff.Path] = fileDiff.Action
+		switch {
+		case fileDiff.Action == ActionDelete || fileDiff.Action == ActionDeleteSource:
+			deletes = append(deletes, fileDiff)
+		case createsDir(fileDiff):
+			dirs = append(dirs, fileDiff)
+		case diff.Links[fileDiff.Path] != "" && (fileDiff.Action == ActionCreate || fileDiff.Action == ActionUpdate):
+			links = append(links, fileDiff)
 		default:
+			files = append(files, fileDiff)
 		}
+	}
 
-		var err error
-		switch fileDiff.Action {
-		case ActionCreate:
-			err = s.create(ctx, fileDiff, sourcePath, destPath)
-			if err == nil {
-				result.FilesCreated++
-				if fileDiff.Source != nil {
-					result.BytesCopied += fileDiff.Source.Size
-				}
-			}
+	// Diffs come in map order from Diff, and parents must come first
+	sort.Slice(dirs, func(a, b int) bool {
+		return fs.ComparePaths(dirs[a].Path, dirs[b].Path) < 0
+	})
+
+	var mu gosync.Mutex
+	failed := make(map[string]bool)
+	apply := func(fileDiff FileDiff) {
+		stats, err := s.apply(ctx, fileDiff, sourcePath, destPath)
+
+		mu.Lock()
+		defer mu.Unlock()
+		result.record(fileDiff, stats, err)
+		if err == nil {
+			s.recordDigest(fileDiff, destPath)
+		} else {
+			failed[fileDiff.Path] = true
+		}
+	}
+
+	// Hard-link group members are linked to the leader's copy once it is
+	// in place, and copied like any other file when that is not possible.
+	link := func(fileDiff FileDiff) {
+		leader := diff.Links[fileDiff.Path]
+
+		mu.Lock()
+		action, changed := actions[leader]
+		ready := !changed || (!failed[leader] && (action == ActionCreate || action == ActionUpdate))
+		mu.Unlock()
+
+		if !ready {
+			apply(fileDiff)
+			return
+		}
+
+		if err := s.hardLink(ctx, fileDiff, diff.destPath(leader), destPath); err != nil {
+			mu.Lock()
+			result.Warnings = append(result.Warnings,
+				fmt.Sprintf("%s: cannot hard link to %s, copied instead: %v", fileDiff.Path, leader, err))
+			mu.Unlock()
+			apply(fileDiff)
+			return
+		}
 
-		case ActionUpdate:
-			err = s.update(ctx, fileDiff, sourcePath, destPath)
-			if err == nil {
-				result.FilesUpdated++
-				if fileDiff.Source != nil {
-					result.BytesCopied += fileDiff.Source.Size
-				}
+		mu.Lock()
+		defer mu.Unlock()
+		result.HardLinks++
+		if fileDiff.Action == ActionCreate {
+			result.FilesCreated++
+		} else {
+			result.FilesUpdated++
+		}
+	}
+
+	if err := runPool(ctx, dirs, 1, apply); err != nil {
+		return result, err
+	}
+	if err := runPool(ctx, files, s.workers(), apply); err != nil {
+		return result, err
+	}
+	if err := runPool(ctx, links, s.workers(), link); err != nil {
+		return result, err
+	}
+	if err := runPool(ctx, deletes, 1, apply); err != nil {
+		return result, err
+	}
+
+	touched := make(dirTargets)
+	for _, fileDiff := range diff.Diffs {
+		touched.add(fileDiff, sourcePath, destPath)
+	}
+	s.applyDirMetadata(touched, destPath, result)
+
+	return result, nil
+}
+
+// dirTargets collects the directories whose metadata is copied once a run
+// is done with them: those it created and the parents of every change.
+type dirTargets map[string]dirPair
+
+// dirPair is a directory and the one its metadata is copied from.
+type dirPair struct{ from, to string }
+
+// add records the directories touched by d.
+func (dirs dirTargets) add(d FileDiff, sourcePath, destPath string) {
+	from, to := sourcePath, destPath
+	fromPath, toPath := d.Path, d.target()
+	switch d.Action {
+	case ActionCreateSource, ActionUpdateSource, ActionDeleteSource:
+		from, to = destPath, sourcePath
+		fromPath, toPath = toPath, fromPath
+	}
+
+	pair := func(fromPath, toPath string) {
+		dirs[filepath.Join(to, toPath)] = dirPair{filepath.Join(from, fromPath), filepath.Join(to, toPath)}
+	}
+	if createsDir(d) {
+		pair(fromPath, toPath)
+	}
+	pair(filepath.Dir(fromPath), filepath.Dir(toPath))
+	if d.Action == ActionMove {
+		pair(filepath.Dir(d.Dest.Path), filepath.Dir(d.Dest.Path))
+	}
+}
+
+// applyDirMetadata copies directory metadata onto every collected
+// directory, deepest first.
+func (s *Syncer) applyDirMetadata(dirs dirTargets, destPath string, result *SyncResult) {
+	targets := make([]string, 0, len(dirs))
+	for target := range dirs {
+		targets = append(targets, target)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(targets)))
+
+	for _, target := range targets {
+		pair := dirs[target]
+		if info, err := os.Stat(pair.to); err != nil || !info.IsDir() {
+			continue // removed during the run
+		}
+		if info, err := os.Stat(pair.from); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := fs.CopyDirMetadata(pair.from, pair.to, s.metadata); err != nil {
+			rel := target
+			if r, err := filepath.Rel(destPath, target); err == nil {
+				rel = r
 			}
+			result.Errors = append(result.Errors, &FileError{Path: rel, Err: err})
+		}
+	}
+}
+
+// createsDir reports whether the diff creates or updates a directory on
+// its target side.
+func createsDir(diff FileDiff) bool {
+	switch diff.Action {
+	case ActionCreate, ActionUpdate:
+		return diff.Source != nil && diff.Source.IsDir
+	case ActionCreateSource, ActionUpdateSource:
+		return diff.Dest != nil && diff.Dest.IsDir
+	}
+	return false
+}
+
+// workers returns the size of the file copy pool.
+func (s *Syncer) workers() int {
+	if s.concurrency <= 0 {
+		return DefaultConcurrency
+	}
+	return s.concurrency
+}
+
+// runPool calls fn for every diff using up to workers goroutines. It stops
+// handing out work once ctx is cancelled and returns ctx.Err() in that case.
+func runPool(ctx context.Context, diffs []FileDiff, workers int, fn func(FileDiff)) error {
+	work := make(chan FileDiff)
+	var wg gosync.WaitGroup
 
-		case ActionDelete:
-			err = s.delete(ctx, fileDiff, destPath)
-			if err == nil {
-				result.FilesDeleted++
+	for i := 0; i < min(workers, len(diffs)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fileDiff := range work {
+				fn(fileDiff)
 			}
+		}()
+	}
+
+feed:
+	for _, fileDiff := range diffs {
+		select {
+		case <-ctx.Done():
+			break feed
+		case work <- fileDiff:
 		}
+	}
+	close(work)
+	wg.Wait()
 
-		if err != nil {
-			result.Errors = append(result.Errors, fmt.Errorf("%s: %w", fileDiff.Path, err))
+	return ctx.Err()
+}
+
+// apply performs a single diff.
+func (s *Syncer) apply(ctx context.Context, fileDiff FileDiff, sourcePath, destPath string) (fs.CopyStats, error) {
+	switch fileDiff.Action {
+	case ActionCreate:
+		return s.create(ctx, fileDiff, sourcePath, destPath)
+	case ActionUpdate:
+		return s.update(ctx, fileDiff, sourcePath, destPath)
+	case ActionDelete:
+		return fs.CopyStats{}, s.delete(ctx, fileDiff.target(), destPath)
+	case ActionCreateSource:
+		return s.create(ctx, fileDiff.reversed(), destPath, sourcePath)
+	case ActionUpdateSource:
+		return s.update(ctx, fileDiff.reversed(), destPath, sourcePath)
+	case ActionDeleteSource:
+		return fs.CopyStats{}, s.delete(ctx, fileDiff.Path, sourcePath)
+	case ActionConflict:
+		return s.resolveConflict(ctx, fileDiff, sourcePath, destPath)
+	case ActionMove:
+		return s.move(ctx, fileDiff, sourcePath, destPath)
+	}
+	return fs.CopyStats{}, nil
+}
+
+// record adds the outcome of one diff to the result counters.
+func (r *SyncResult) record(diff FileDiff, stats fs.CopyStats, err error) {
+	if diff.Action == ActionConflict {
+		r.Conflicts++
+	}
+	if errors.Is(err, errConflictSkipped) {
+		r.Warnings = append(r.Warnings, diff.Path+": "+err.Error())
+		return
+	}
+	if err != nil {
+		r.Errors = append(r.Errors, &FileError{Path: diff.Path, Err: err})
+		return
+	}
+
+	r.BytesWritten += stats.BytesWritten
+	r.BytesAllocated += stats.BytesAllocated
+	if stats.Method != fs.CopyNone {
+		r.countMethod(stats.Method, 1)
+	}
+
+	switch diff.Action {
+	case ActionCreate, ActionUpdate:
+		if diff.Source != nil {
+			r.BytesCopied += diff.Source.Size
+		}
+	case ActionCreateSource, ActionUpdateSource:
+		if diff.Dest != nil {
+			r.BytesCopied += diff.Dest.Size
 		}
 	}
 
-	return result, nil
+	switch diff.Action {
+	case ActionCreate, ActionCreateSource:
+		r.FilesCreated++
+	case ActionUpdate, ActionUpdateSource:
+		r.FilesUpdated++
+	case ActionDelete, ActionDeleteSource:
+		r.FilesDeleted++
+	case ActionMove:
+		r.FilesMoved++
+	}
+}
+
+// merge adds the counters, errors and warnings of other to r.
+func (r *SyncResult) merge(other *SyncResult) {
+	r.FilesCreated += other.FilesCreated
+	r.FilesUpdated += other.FilesUpdated
+	r.FilesDeleted += other.FilesDeleted
+	r.FilesMoved += other.FilesMoved
+	r.BytesCopied += other.BytesCopied
+	r.BytesWritten += other.BytesWritten
+	r.BytesAllocated += other.BytesAllocated
+	r.Conflicts += other.Conflicts
+	r.HardLinks += other.HardLinks
+	r.Errors = append(r.Errors, other.Errors...)
+	r.Warnings = append(r.Warnings, other.Warnings...)
+	for method, n := range other.CopyMethods {
+		r.countMethod(method, n)
+	}
+}
+
+// countMethod adds n files copied by method.
+func (r *SyncResult) countMethod(method fs.CopyMethod, n int) {
+	if r.CopyMethods == nil {
+		r.CopyMethods = make(map[fs.CopyMethod]int)
+	}
+	r.CopyMethods[method] += n
+}
+
+// CopyMethodSummary lists the number of files copied by each method, such
+// as "reflink 3, buffered 1", or returns "" when nothing was copied.
+func (r *SyncResult) CopyMethodSummary() string {
+	methods := make([]fs.CopyMethod, 0, len(r.CopyMethods))
+	for method := range r.CopyMethods {
+		methods = append(methods, method)
+	}
+	sort.Slice(methods, func(i, j int) bool { return methods[i] < methods[j] })
+
+	parts := make([]string, len(methods))
+	for i, method := range methods {
+		parts[i] = fmt.Sprintf("%s %d", method, r.CopyMethods[method])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// recordDigest caches the source digest for a freshly copied destination
+// file, so the next run does not need to hash it again.
+func (s *Syncer) recordDigest(diff FileDiff, destPath string) {
+	if s.checksums == nil || diff.Source == nil || diff.Source.Digest == "" {
+		return
+	}
+	if diff.Action != ActionCreate && diff.Action != ActionUpdate {
+		return
+	}
+
+	if err := s.checksums.Record(filepath.Join(destPath, diff.target()), diff.Source.Digest); err != nil {
+		log.Printf("Record digest for %s: %v", diff.Path, err)
+	}
 }
 
 // create handles creating a new file or directory at destination.
-func (s *Syncer) create(ctx context.Context, diff FileDiff, sourcePath, destPath string) error {
+func (s *Syncer) create(ctx context.Context, diff FileDiff, sourcePath, destPath string) (fs.CopyStats, error) {
+	var stats fs.CopyStats
 	if diff.Source == nil {
-		return fmt.Errorf("no source file info")
+		return stats, fmt.Errorf("no source file info")
 	}
 
 	srcPath := filepath.Join(sourcePath, diff.Path)
-	dstPath := filepath.Join(destPath, diff.Path)
+	dstPath := filepath.Join(destPath, diff.target())
 
 	if diff.Source.IsDir {
-		return os.MkdirAll(dstPath, 0755)
+		return stats, createDir(srcPath, dstPath)
 	}
 
-	if err := s.copier.Copy(srcPath, dstPath); err != nil {
-		return fmt.Errorf("copy file: %w", err)
+	if diff.Source.IsSymlink {
+		return stats, s.createSymlink(diff, sourcePath, destPath)
 	}
 
+	// Both copiers write under a temporary name first, so an interrupted
+	// copy never leaves a truncated file at dstPath
+	stats, err := s.retryVerify(diff.Path, func() (fs.CopyStats, error) {
+		if rc := s.resumable(diff); rc != nil {
+			return rc.CopyResumable(ctx, srcPath, dstPath)
+		}
+		return s.copier.Copy(ctx, srcPath, dstPath)
+	})
+	if err != nil {
+		return stats, fmt.Errorf("copy file: %w", err)
+	}
+
+	return stats, nil
+}
+
+// createDir creates dstPath with the permissions of the directory at
+// srcPath, kept writable by the owner like CopyDirMetadata does, so the
+// directory is never more open than its source while the run fills it.
+func createDir(srcPath, dstPath string) error {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return fmt.Errorf("stat source directory: %w", err)
+	}
+	if err := os.MkdirAll(dstPath, info.Mode().Perm()|0700); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
 	return nil
 }
 
-// update handles updating an existing file at destination.
-// Uses atomic rename pattern to avoid corrupting files on interruption.
-func (s *Syncer) update(ctx context.Context, diff FileDiff, sourcePath, destPath string) error {
+// update handles updating an existing file at destination. The copier
+// writes the new contents beside it and renames them over it, so an
+// interrupted update leaves the old copy intact.
+func (s *Syncer) update(ctx context.Context, diff FileDiff, sourcePath, destPath string) (fs.CopyStats, error) {
+	var stats fs.CopyStats
 	if diff.Source == nil {
-		return fmt.Errorf("no source file info")
+		return stats, fmt.Errorf("no source file info")
 	}
 
 	srcPath := filepath.Join(sourcePath, diff.Path)
-	dstPath := filepath.Join(destPath, diff.Path)
+	dstPath := filepath.Join(destPath, diff.target())
 
 	if diff.Source.IsDir {
-		return os.MkdirAll(dstPath, 0755)
+		return stats, createDir(srcPath, dstPath)
 	}
 
-	// Create temporary file in same directory as destination
-	// (same filesystem = atomic rename)
-	dstDir := filepath.Dir(dstPath)
-	tmpFile, err := os.CreateTemp(dstDir, ".mirrorbox-tmp-*")
-	if err != nil {
-		return fmt.Errorf("create temp file: %w", err)
+	if err := s.keepVersion(ctx, destPath, diff.target()); err != nil {
+		return stats, err
 	}
-	tmpPath := tmpFile.Name()
-	tmpFile.Close()
 
-	// Clean up temp file on error
-	defer func() {
+	if diff.Source.IsSymlink {
+		return stats, s.createSymlink(diff, sourcePath, destPath)
+	}
+
+	// Large files go through a resumable partial file, which is renamed
+	// over the destination once complete
+	if rc := s.resumable(diff); rc != nil && !s.useDelta(diff) {
+		stats, err := s.retryVerify(diff.Path, func() (fs.CopyStats, error) {
+			return rc.CopyResumable(ctx, srcPath, dstPath)
+		})
 		if err != nil {
-			os.Remove(tmpPath)
+			return stats, fmt.Errorf("copy file: %w", err)
 		}
-	}()
+		return stats, nil
+	}
 
-	if err = s.copier.Copy(srcPath, tmpPath); err != nil {
-		return fmt.Errorf("copy to temp: %w", err)
+	// Rebuild large files from the existing copy when delta mode is on
+	stats, err := s.retryVerify(diff.Path, func() (fs.CopyStats, error) {
+		if dc, ok := s.copier.(fs.DeltaCopier); ok && s.useDelta(diff) {
+			return dc.CopyDelta(ctx, srcPath, dstPath, dstPath)
+		}
+		return s.copier.Copy(ctx, srcPath, dstPath)
+	})
+	if err != nil {
+		return stats, fmt.Errorf("copy file: %w", err)
 	}
 
-	if err = os.Rename(tmpPath, dstPath); err != nil {
-		return fmt.Errorf("rename temp to dest: %w", err)
+	return stats, nil
+}
+
+// retryVerify runs transfer and repeats it when the written file fails
+// verification, up to verifyRetries times. The last error is returned.
+func (s *Syncer) retryVerify(path string, transfer func() (fs.CopyStats, error)) (fs.CopyStats, error) {
+	stats, err := transfer()
+
+	var verifyErr *fs.VerifyError
+	for attempt := 1; attempt <= verifyRetries && errors.As(err, &verifyErr); attempt++ {
+		log.Printf("Retrying %s after failed verification (attempt %d)", path, attempt)
+		var retry fs.CopyStats
+		retry, err = transfer()
+		stats.BytesWritten += retry.BytesWritten
+		stats.BytesAllocated = retry.BytesAllocated
+		stats.Method = retry.Method
 	}
 
-	return nil
+	return stats, err
 }
 
-func (s *Syncer) delete(ctx context.Context, diff FileDiff, destPath string) error {
-	targetPath := filepath.Join(destPath, diff.Path)
+// resumable returns the copier to use for a resumable transfer of the diff's
+// source file, or nil when the file is too small or the copier cannot resume.
+func (s *Syncer) resumable(diff FileDiff) fs.ResumableCopier {
+	rc, ok := s.copier.(fs.ResumableCopier)
+	if !ok || diff.Source.Size < resumeMinSize {
+		return nil
+	}
+	return rc
+}
+
+// useDelta reports whether an update should be sent as a delta against
+// the existing destination file.
+func (s *Syncer) useDelta(diff FileDiff) bool {
+	if !s.delta || diff.Dest == nil {
+		return false
+	}
+	return !diff.Dest.IsDir && !diff.Dest.IsSymlink && diff.Dest.Size >= deltaMinSize
+}
+
+// delete removes path below root, which is the destination for
+// ActionDelete and the source for ActionDeleteSource.
+func (s *Syncer) delete(ctx context.Context, path, root string) error {
+	if err := s.keepVersion(ctx, root, path); err != nil {
+		return err
+	}
+
+	targetPath := filepath.Join(root, path)
 	return os.RemoveAll(targetPath)
 }
@@ -0,0 +1,143 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"excellgene.com/mirrorBox/internal/sync/fs"
+)
+
+// corruptingCopier reports its first copies, as many as failures, as
+// failing verification, as if the data read back did not match the source.
+type corruptingCopier struct {
+	failures int
+	calls    int
+}
+
+func (c *corruptingCopier) Copy(ctx context.Context, srcPath, dstPath string) (fs.CopyStats, error) {
+	c.calls++
+	if c.calls <= c.failures {
+		return fs.CopyStats{BytesWritten: 1}, &fs.VerifyError{Path: dstPath, Want: "good", Got: "bad"}
+	}
+	return fs.CopyStats{BytesWritten: 1}, os.WriteFile(dstPath, []byte("a"), 0644)
+}
+
+func TestSyncVerifyRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		wantCalls int
+		wantError bool
+	}{
+		{"verified", 0, 1, false},
+		{"retried", verifyRetries, verifyRetries + 1, false},
+		{"failed", verifyRetries + 1, verifyRetries + 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := t.TempDir(), t.TempDir()
+			if err := os.WriteFile(filepath.Join(src, "a"), []byte("a"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			copier := &corruptingCopier{failures: tt.failures}
+			source := testFile("a", 1, 100)
+			diff := &DiffResult{Diffs: []FileDiff{{Path: "a", Action: ActionCreate, Source: &source}}}
+
+			result, err := NewSyncer(copier).Sync(context.Background(), diff, src, dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if copier.calls != tt.wantCalls {
+				t.Errorf("copied %d times, want %d", copier.calls, tt.wantCalls)
+			}
+
+			if !tt.wantError {
+				if len(result.Errors) != 0 || result.FilesCreated != 1 {
+					t.Errorf("created %d with errors %v, want the file created", result.FilesCreated, result.Errors)
+				}
+				return
+			}
+			var verifyErr *fs.VerifyError
+			if len(result.Errors) != 1 || !errors.As(result.Errors[0], &verifyErr) {
+				t.Errorf("errors %v, want one verification error", result.Errors)
+			}
+			if result.FilesCreated != 0 {
+				t.Errorf("created %d, want the failed file not counted", result.FilesCreated)
+			}
+		})
+	}
+}
+
+func TestCopyMethodSummary(t *testing.T) {
+	var r SyncResult
+	if got := r.CopyMethodSummary(); got != "" {
+		t.Errorf("nothing copied: got %q", got)
+	}
+
+	r.countMethod(fs.CopySendfile, 1)
+	r.countMethod(fs.CopyReflink, 2)
+	r.countMethod(fs.CopyBuffered, 1)
+	r.countMethod(fs.CopyReflink, 1)
+	if got, want := r.CopyMethodSummary(), "buffered 1, reflink 3, sendfile 1"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// modeCopier copies like a LocalCopier and records the permissions the
+// destination's parent directory had when each file was copied into it.
+type modeCopier struct {
+	fs.LocalCopier
+	modes map[string]os.FileMode
+}
+
+func (c *modeCopier) Copy(ctx context.Context, srcPath, dstPath string) (fs.CopyStats, error) {
+	info, err := os.Stat(filepath.Dir(dstPath))
+	if err != nil {
+		return fs.CopyStats{}, err
+	}
+	c.modes[filepath.Base(dstPath)] = info.Mode().Perm()
+	return c.LocalCopier.Copy(ctx, srcPath, dstPath)
+}
+
+func TestSyncDirectoryModes(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	outer, inner := filepath.Join(src, "d"), filepath.Join(src, "d", "e")
+	if err := os.MkdirAll(inner, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for path, data := range map[string]string{filepath.Join(outer, "a"): "a", filepath.Join(inner, "b"): "b"} {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(outer, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	source := []fs.FileInfo{
+		testDir("d"),
+		testDir(filepath.Join("d", "e")),
+		testFile(filepath.Join("d", "a"), 1, 100),
+		testFile(filepath.Join("d", "e", "b"), 1, 100),
+	}
+	copier := &modeCopier{LocalCopier: *fs.NewLocalCopier(true), modes: make(map[string]os.FileMode)}
+	result, err := NewSyncer(copier).Sync(context.Background(), NewDiffer().Diff(source, nil), src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Errors) != 0 {
+		t.Fatalf("errors %v", result.Errors)
+	}
+
+	// The directories already have their source modes while files are copied
+	for name, want := range map[string]os.FileMode{"a": 0750, "b": 0700} {
+		if got := copier.modes[name]; got != want {
+			t.Errorf("%s copied into a directory with mode %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package sync
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"excellgene.com/mirrorBox/internal/sync/fs"
+)
+
+// change classifies what happened to one side of a path since the last sync.
+type change int
+
+const (
+	changeAbsent    change = iota // not present now or at the last sync
+	changeUnchanged               // same as at the last sync
+	changeAdded                   // new since the last sync
+	changeModified                // present before, contents changed
+	changeDeleted                 // present before, gone now
+)
+
+func classify(f fs.FileInfo, exists bool, base fileState, known bool, sameTime func(a, b int64) bool) change {
+	switch {
+	case !known && exists:
+		return changeAdded
+	case !known:
+		return changeAbsent
+	case !exists:
+		return changeDeleted
+	case base.changedSince(f, sameTime):
+		return changeModified
+	default:
+		return changeUnchanged
+	}
+}
+
+// DiffTwoWay compares both sides against the last-synced state and returns
+// the actions that propagate each side's changes to the other. Paths changed
+// on both sides are reported as ActionConflict.
+func (d *Differ) DiffTwoWay(source, dest []fs.FileInfo, state *SyncState) *DiffResult {
+	sourceMap, skipped := d.sourceMap(source)
+	destMap, destExtra := d.destMap(dest, sourceMap)
+	destPaths := d.destPaths(sourceMap, destMap, skipped)
+	sourceName := d.namer(sourceMap, d.destKey, func(base string) (string, error) {
+		return base, nil
+	})
+	paths := make(map[string]struct{}, len(source))
+
+	for key := range sourceMap {
+		paths[key] = struct{}{}
+	}
+	for key := range destMap {
+		paths[key] = struct{}{}
+	}
+	for key := range state.entries {
+		paths[key] = struct{}{}
+	}
+
+	sorted := make([]string, 0, len(paths))
+	for key := range paths {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	var diffs []FileDiff
+
+	for _, key := range sorted {
+		srcFile, srcOK := sourceMap[key]
+		destFile, destOK := destMap[key]
+		base, known := state.entries[key]
+
+		// Destination times are only as precise as its filesystem keeps them
+		srcChange := classify(srcFile, srcOK, base.Source, known, exactTime)
+		destChange := classify(destFile, destOK, base.Dest, known, d.sameTime)
+
+		diff := FileDiff{Path: key}
+		if srcOK {
+			diff.Source = &srcFile
+			diff.Path = srcFile.Path
+			diff.DestPath = destPaths[srcFile.Path]
+		}
+		if destOK {
+			diff.Dest = &destFile
+			if !srcOK {
+				if known, ok := d.knownSource(destFile.Path); ok {
+					diff.Path = known
+				} else {
+					diff.Path, _ = sourceName(destFile.Path) // keeps base names, never fails
+				}
+				if diff.Path != destFile.Path {
+					diff.DestPath = destFile.Path
+				}
+			}
+		}
+
+		srcChanged := srcChange == changeAdded || srcChange == changeModified
+		destChanged := destChange == changeAdded || destChange == changeModified
+
+		switch {
+		case srcChanged && destChanged:
+			if d.inSync(diff.Source, diff.Dest) {
+				continue
+			}
+			diff.Action = ActionConflict
+
+		case srcChanged:
+			diff.Action = ActionUpdate
+			if !destOK {
+				diff.Action = ActionCreate
+			}
+
+		case destChanged:
+			diff.Action = ActionUpdateSource
+			if !srcOK {
+				diff.Action = ActionCreateSource
+			}
+
+		case srcChange == changeDeleted && destChange == changeUnchanged:
+			diff.Action = ActionDelete
+
+		case destChange == changeDeleted && srcChange == changeUnchanged:
+			diff.Action = ActionDeleteSource
+
+		default:
+			continue
+		}
+
+		diffs = append(diffs, diff)
+	}
+
+	// A second destination entry under the name of another has nowhere to
+	// go in the source, so it is left alone and reported
+	for _, destFile := range destExtra {
+		if skipped == nil {
+			skipped = make(map[string]error)
+		}
+		skipped[destFile.Path] = &NameCollisionError{Other: destMap[d.destKey(destFile.Path)].Path}
+	}
+
+	return &DiffResult{
+		Diffs:     d.keepSurvivingDirs(diffs),
+		Links:     hardLinkLeaders(source),
+		DestPaths: destPaths,
+		Skipped:   skipped,
+	}
+}
+
+// inSync reports whether two independently changed entries already match.
+func (d *Differ) inSync(source, dest *fs.FileInfo) bool {
+	if source.IsSymlink || dest.IsSymlink {
+		return source.IsSymlink && dest.IsSymlink && source.LinkTarget == dest.LinkTarget
+	}
+	if source.IsDir || dest.IsDir {
+		return source.IsDir && dest.IsDir
+	}
+	return source.Size == dest.Size && d.sameTime(source.ModTime, dest.ModTime)
+}
+
+// keepSurvivingDirs turns the deletion of a directory into its re-creation
+// on the deleting side when the other side still has new or changed entries
+// inside it, so those entries are not removed along with the directory.
+func (d *Differ) keepSurvivingDirs(diffs []FileDiff) []FileDiff {
+	var destSurvivors, sourceSurvivors []string
+	for _, diff := range diffs {
+		switch diff.Action {
+		case ActionCreateSource, ActionUpdateSource:
+			destSurvivors = append(destSurvivors, d.key(diff.Path))
+		case ActionCreate, ActionUpdate:
+			sourceSurvivors = append(sourceSurvivors, d.key(diff.Path))
+		case ActionConflict:
+			destSurvivors = append(destSurvivors, d.key(diff.Path))
+			sourceSurvivors = append(sourceSurvivors, d.key(diff.Path))
+		}
+	}
+	sort.Strings(destSurvivors)
+	sort.Strings(sourceSurvivors)
+
+	for i, diff := range diffs {
+		switch {
+		case diff.Action == ActionDelete && diff.Dest.IsDir && hasDescendant(destSurvivors, d.key(diff.Path)):
+			diffs[i].Action = ActionCreateSource
+		case diff.Action == ActionDeleteSource && diff.Source.IsDir && hasDescendant(sourceSurvivors, d.key(diff.Path)):
+			diffs[i].Action = ActionCreate
+		}
+	}
+
+	return diffs
+}
+
+// hasDescendant reports whether the sorted list contains a path below dir.
+func hasDescendant(sorted []string, dir string) bool {
+	prefix := dir + string(filepath.Separator)
+	i := sort.SearchStrings(sorted, prefix)
+	return i < len(sorted) && strings.HasPrefix(sorted[i], prefix)
+}
@@ -0,0 +1,217 @@
+package sync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"excellgene.com/mirrorBox/internal/sync/fs"
+)
+
+func testFile(path string, size, mtime int64) fs.FileInfo {
+	return fs.FileInfo{Path: path, Size: size, ModTime: mtime}
+}
+
+func testDir(path string) fs.FileInfo {
+	return fs.FileInfo{Path: path, IsDir: true}
+}
+
+func synced(f fs.FileInfo) stateEntry {
+	return stateEntry{Source: newFileState(f), Dest: newFileState(f)}
+}
+
+func TestDiffTwoWay(t *testing.T) {
+	a := testFile("a.txt", 10, 100)
+
+	tests := []struct {
+		name   string
+		source []fs.FileInfo
+		dest   []fs.FileInfo
+		state  map[string]stateEntry
+		want   map[string]Action
+	}{
+		{
+			name:   "unchanged",
+			source: []fs.FileInfo{a},
+			dest:   []fs.FileInfo{a},
+			state:  map[string]stateEntry{"a.txt": synced(a)},
+			want:   map[string]Action{},
+		},
+		{
+			name:   "added at source",
+			source: []fs.FileInfo{a},
+			want:   map[string]Action{"a.txt": ActionCreate},
+		},
+		{
+			name: "added at destination",
+			dest: []fs.FileInfo{a},
+			want: map[string]Action{"a.txt": ActionCreateSource},
+		},
+		{
+			name:   "modified at source",
+			source: []fs.FileInfo{testFile("a.txt", 12, 200)},
+			dest:   []fs.FileInfo{a},
+			state:  map[string]stateEntry{"a.txt": synced(a)},
+			want:   map[string]Action{"a.txt": ActionUpdate},
+		},
+		{
+			name:   "modified at destination",
+			source: []fs.FileInfo{a},
+			dest:   []fs.FileInfo{testFile("a.txt", 10, 200)},
+			state:  map[string]stateEntry{"a.txt": synced(a)},
+			want:   map[string]Action{"a.txt": ActionUpdateSource},
+		},
+		{
+			name:  "deleted at source",
+			dest:  []fs.FileInfo{a},
+			state: map[string]stateEntry{"a.txt": synced(a)},
+			want:  map[string]Action{"a.txt": ActionDelete},
+		},
+		{
+			name:   "deleted at destination",
+			source: []fs.FileInfo{a},
+			state:  map[string]stateEntry{"a.txt": synced(a)},
+			want:   map[string]Action{"a.txt": ActionDeleteSource},
+		},
+		{
+			name:  "deleted on both sides",
+			state: map[string]stateEntry{"a.txt": synced(a)},
+			want:  map[string]Action{},
+		},
+		{
+			name:   "modified on both sides",
+			source: []fs.FileInfo{testFile("a.txt", 11, 200)},
+			dest:   []fs.FileInfo{testFile("a.txt", 12, 300)},
+			state:  map[string]stateEntry{"a.txt": synced(a)},
+			want:   map[string]Action{"a.txt": ActionConflict},
+		},
+		{
+			name:   "same change on both sides",
+			source: []fs.FileInfo{testFile("a.txt", 11, 200)},
+			dest:   []fs.FileInfo{testFile("a.txt", 11, 200)},
+			state:  map[string]stateEntry{"a.txt": synced(a)},
+			want:   map[string]Action{},
+		},
+		{
+			name:  "modified at destination, deleted at source",
+			dest:  []fs.FileInfo{testFile("a.txt", 10, 200)},
+			state: map[string]stateEntry{"a.txt": synced(a)},
+			want:  map[string]Action{"a.txt": ActionCreateSource},
+		},
+		{
+			name: "directory deleted at source with new contents at destination",
+			dest: []fs.FileInfo{testDir("d"), testFile(filepath.Join("d", "new.txt"), 1, 100)},
+			state: map[string]stateEntry{
+				"d": synced(testDir("d")),
+			},
+			want: map[string]Action{
+				"d":                           ActionCreateSource,
+				filepath.Join("d", "new.txt"): ActionCreateSource,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &SyncState{entries: tt.state}
+			if state.entries == nil {
+				state.entries = make(map[string]stateEntry)
+			}
+
+			result := NewDiffer().DiffTwoWay(tt.source, tt.dest, state)
+
+			got := make(map[string]Action)
+			for _, d := range result.Diffs {
+				got[d.Path] = d.Action
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for path, action := range tt.want {
+				if got[path] != action {
+					t.Errorf("%s: got %v, want %v", path, got[path], action)
+				}
+			}
+		})
+	}
+}
+
+func TestRunTwoWayRewrittenLink(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "x"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(src, "x"), filepath.Join(src, "l")); err != nil {
+		t.Fatal(err)
+	}
+
+	job := NewJob("test", src, dst, Options{TwoWay: true, RewriteLinks: true})
+
+	// The first run copies both entries, and the next must find nothing to do
+	settled := false
+	for run := 0; run < 3 && !settled; run++ {
+		if _, err := job.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		plan, err := job.Plan(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		settled = len(plan.Diff.Diffs) == 0
+	}
+	if !settled {
+		t.Fatal("the link is synced again on every run")
+	}
+
+	for root, want := range map[string]string{src: filepath.Join(src, "x"), dst: filepath.Join(dst, "x")} {
+		if got, err := os.Readlink(filepath.Join(root, "l")); err != nil || got != want {
+			t.Errorf("link in %s points to %q (%v), want %q", root, got, err, want)
+		}
+	}
+}
+
+func TestRunTwoWayCoarseDestination(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	path := filepath.Join(src, "a")
+	if err := os.WriteFile(path, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	odd := time.Unix(1700000001, 0)
+	if err := os.Chtimes(path, odd, odd); err != nil {
+		t.Fatal(err)
+	}
+
+	job := NewJob("test", src, dst, Options{TwoWay: true})
+	job.caps = &fs.Capabilities{ModTimeGranularity: 2 * time.Second, CaseSensitive: true, Symlinks: true, Xattrs: true, MaxNameLength: fs.MaxNameLength}
+	job.adapt(*job.caps)
+	if _, err := job.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A FAT destination keeps the time rounded down to 2s
+	even := odd.Add(-time.Second)
+	if err := os.Chtimes(filepath.Join(dst, "a"), even, even); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := job.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Diff.Diffs) != 0 {
+		t.Fatalf("rounded destination time planned %v, want nothing", plan.Diff.Diffs)
+	}
+
+	// An edit of the source is an update, not a conflict
+	if err := os.WriteFile(path, []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	plan, err = job.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Diff.Diffs) != 1 || plan.Diff.Diffs[0].Action != ActionUpdate {
+		t.Errorf("source edit planned %v, want one update", plan.Diff.Diffs)
+	}
+}
@@ -0,0 +1,247 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// VersionsDir is the directory, below each synced root, that holds the
+// previous contents of overwritten and deleted files.
+const VersionsDir = ".mirrorbox-versions"
+
+// versionTimeFormat names each kept version after the time it was replaced.
+const versionTimeFormat = "20060102-150405.000000"
+
+// VersioningMode selects whether replaced files are kept and how long.
+type VersioningMode int
+
+const (
+	VersioningOff       VersioningMode = iota // replaced files are lost
+	VersioningCount                           // keep the newest N versions of each file
+	VersioningDays                            // keep versions for N days
+	VersioningStaggered                       // thin out versions as they age
+)
+
+// ParseVersioningMode converts a config value into a VersioningMode.
+// The empty string selects VersioningOff.
+func ParseVersioningMode(s string) (VersioningMode, error) {
+	switch s {
+	case "", "off":
+		return VersioningOff, nil
+	case "count":
+		return VersioningCount, nil
+	case "days":
+		return VersioningDays, nil
+	case "staggered":
+		return VersioningStaggered, nil
+	default:
+		return VersioningOff, fmt.Errorf("unknown versioning mode: %q", s)
+	}
+}
+
+func (m VersioningMode) String() string {
+	switch m {
+	case VersioningCount:
+		return "count"
+	case VersioningDays:
+		return "days"
+	case VersioningStaggered:
+		return "staggered"
+	default:
+		return "off"
+	}
+}
+
+// Versioning is a retention policy for replaced files. Keep is the number
+// of versions for VersioningCount and the maximum age in days for
+// VersioningDays and VersioningStaggered (0 = forever).
+type Versioning struct {
+	Mode VersioningMode
+	Keep int
+}
+
+// keepVersion preserves the current contents of root/path before it is
+// overwritten or deleted. Directories are preserved file by file.
+func (s *Syncer) keepVersion(ctx context.Context, root, path string) error {
+	if s.versioning.Mode == VersioningOff {
+		return nil
+	}
+
+	target := filepath.Join(root, path)
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("keep version: %w", err)
+	}
+
+	stamp := time.Now().UTC().Format(versionTimeFormat)
+
+	if !info.IsDir() {
+		return s.saveVersion(ctx, target, versionPath(root, path, stamp), info)
+	}
+
+	return filepath.WalkDir(target, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		return s.saveVersion(ctx, p, versionPath(root, rel, stamp), info)
+	})
+}
+
+func versionPath(root, path, stamp string) string {
+	return filepath.Join(root, VersionsDir, path, stamp)
+}
+
+// saveVersion hard-links the file into the versions area, so the version
+// survives the file being replaced or removed without copying any data.
+// It falls back to a copy made by the syncer's copier, which streams the
+// data, where hard links are not supported.
+func (s *Syncer) saveVersion(ctx context.Context, path, version string, info os.FileInfo) error {
+	if err := os.MkdirAll(filepath.Dir(version), 0755); err != nil {
+		return fmt.Errorf("create versions directory: %w", err)
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return fmt.Errorf("keep version: %w", err)
+		}
+		if err := os.Symlink(target, version); err != nil {
+			return fmt.Errorf("keep version: %w", err)
+		}
+		return nil
+	}
+
+	if err := os.Link(path, version); err == nil {
+		return nil
+	}
+
+	if _, err := s.copier.Copy(ctx, path, version); err != nil {
+		os.Remove(version)
+		return fmt.Errorf("keep version: %w", err)
+	}
+	return nil
+}
+
+// PruneVersions removes the versions below root that the policy no longer
+// keeps, along with directories left empty.
+func PruneVersions(root string, policy Versioning, now time.Time) error {
+	base := filepath.Join(root, VersionsDir)
+	if _, err := os.Stat(base); os.IsNotExist(err) {
+		return nil
+	}
+
+	// Versions of one file share a directory and are named by timestamp.
+	groups := make(map[string][]time.Time)
+	var dirs []string
+	err := filepath.WalkDir(base, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(dirs, p)
+			return nil
+		}
+		t, err := time.Parse(versionTimeFormat, d.Name())
+		if err != nil {
+			return nil // not ours
+		}
+		dir := filepath.Dir(p)
+		groups[dir] = append(groups[dir], t)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("scan versions: %w", err)
+	}
+
+	for dir, versions := range groups {
+		sort.Slice(versions, func(i, j int) bool { return versions[i].After(versions[j]) })
+
+		for _, t := range expiredVersions(versions, policy, now) {
+			p := filepath.Join(dir, t.Format(versionTimeFormat))
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("remove version: %w", err)
+			}
+		}
+	}
+
+	// Deepest first, so parents are empty by the time they are reached.
+	// Removing a non-empty directory fails, which is what we want.
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		os.Remove(dir)
+	}
+
+	return nil
+}
+
+// expiredVersions returns the versions, sorted newest first, that the
+// policy drops.
+func expiredVersions(versions []time.Time, policy Versioning, now time.Time) []time.Time {
+	var expired []time.Time
+	maxAge := time.Duration(policy.Keep) * 24 * time.Hour
+
+	switch policy.Mode {
+	case VersioningCount:
+		if policy.Keep > 0 && len(versions) > policy.Keep {
+			expired = versions[policy.Keep:]
+		}
+
+	case VersioningDays:
+		for _, t := range versions {
+			if policy.Keep > 0 && now.Sub(t) > maxAge {
+				expired = append(expired, t)
+			}
+		}
+
+	case VersioningStaggered:
+		var lastKept time.Time
+		for i, t := range versions {
+			age := now.Sub(t)
+			switch {
+			case policy.Keep > 0 && age > maxAge:
+				expired = append(expired, t)
+			case i > 0 && lastKept.Sub(t) < staggerInterval(age):
+				expired = append(expired, t)
+			default:
+				lastKept = t
+			}
+		}
+	}
+
+	return expired
+}
+
+// staggerInterval is the minimum spacing between kept versions of a given
+// age: every version for the first hour, then one per hour for a day, one
+// per day for a month, and one per week after that.
+func staggerInterval(age time.Duration) time.Duration {
+	switch {
+	case age < time.Hour:
+		return 0
+	case age < 24*time.Hour:
+		return time.Hour
+	case age < 30*24*time.Hour:
+		return 24 * time.Hour
+	default:
+		return 7 * 24 * time.Hour
+	}
+}
@@ -0,0 +1,90 @@
+package sync
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExpiredVersions(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	const day = 24 * time.Hour
+
+	// ago turns ages into version times, which are listed newest first
+	ago := func(ages ...time.Duration) []time.Time {
+		var times []time.Time
+		for _, age := range ages {
+			times = append(times, now.Add(-age))
+		}
+		return times
+	}
+
+	tests := []struct {
+		name     string
+		policy   Versioning
+		versions []time.Time
+		want     []time.Time
+	}{
+		{
+			name:     "count keeps the newest",
+			policy:   Versioning{Mode: VersioningCount, Keep: 2},
+			versions: ago(time.Minute, time.Hour, day),
+			want:     ago(day),
+		},
+		{
+			name:     "days drops the older",
+			policy:   Versioning{Mode: VersioningDays, Keep: 7},
+			versions: ago(time.Hour, 6*day, 8*day),
+			want:     ago(8 * day),
+		},
+		{
+			name:     "staggered keeps everything within an hour",
+			policy:   Versioning{Mode: VersioningStaggered},
+			versions: ago(time.Minute, 10*time.Minute, 30*time.Minute, 59*time.Minute),
+		},
+		{
+			name:     "staggered keeps one per hour within a day",
+			policy:   Versioning{Mode: VersioningStaggered},
+			versions: ago(2*time.Hour, 2*time.Hour+30*time.Minute, 3*time.Hour, 3*time.Hour+10*time.Minute),
+			want:     ago(2*time.Hour+30*time.Minute, 3*time.Hour+10*time.Minute),
+		},
+		{
+			name:     "staggered keeps one per day within a month",
+			policy:   Versioning{Mode: VersioningStaggered},
+			versions: ago(2*day, 2*day+12*time.Hour, 3*day, 3*day+time.Hour),
+			want:     ago(2*day+12*time.Hour, 3*day+time.Hour),
+		},
+		{
+			name:     "staggered keeps one per week after a month",
+			policy:   Versioning{Mode: VersioningStaggered},
+			versions: ago(31*day, 35*day, 38*day, 44*day),
+			want:     ago(35*day, 44*day),
+		},
+		{
+			name:     "staggered spacing is measured from the last kept version",
+			policy:   Versioning{Mode: VersioningStaggered},
+			versions: ago(2*time.Hour, 2*time.Hour+40*time.Minute, 3*time.Hour+20*time.Minute),
+			want:     ago(2*time.Hour + 40*time.Minute),
+		},
+		{
+			name:     "staggered drops versions past the maximum age",
+			policy:   Versioning{Mode: VersioningStaggered, Keep: 10},
+			versions: ago(time.Hour, 9*day, 11*day, 30*day),
+			want:     ago(11*day, 30*day),
+		},
+		{
+			name:     "staggered without a maximum age keeps old versions",
+			policy:   Versioning{Mode: VersioningStaggered},
+			versions: ago(31*day, 400*day),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := expiredVersions(tt.versions, tt.policy, now)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expiredVersions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"excellgene.com/mirrorBox/internal/sync/fs"
+)
+
+// subtreeWalker is implemented by walkers that can walk part of a tree.
+type subtreeWalker interface {
+	WalkSubtree(rel string, fn func(fs.FileInfo) error) error
+}
+
+// NewWatcher returns a watcher of the job's source tree, which reports
+// the paths to pass to RunSubtrees.
+func (j *Job) NewWatcher() (*fs.TreeWatcher, error) {
+	walker, ok := j.sourceWalker.(*fs.LocalWalker)
+	if !ok {
+		return nil, fmt.Errorf("source of job %s cannot be watched", j.Name)
+	}
+	return fs.NewTreeWatcher(walker)
+}
+
+// RunSubtrees syncs the given paths, relative to the source root, and
+// everything below them, instead of both whole trees. Moves are copied and
+// deleted rather than renamed.
+//
+// A full Run is made instead when the diff needs whole listings: for
+// two-way jobs, for jobs that match names across Unicode forms or letter
+// case, when the paths include hard-linked files or the root, and before
+// the first full run has measured the destination for the deletion limits.
+func (j *Job) RunSubtrees(ctx context.Context, paths []string) (*SyncResult, error) {
+	if !j.busy.TryLock() {
+		return nil, ErrJobRunning
+	}
+	defer j.busy.Unlock()
+
+	source, sourceOK := j.sourceWalker.(subtreeWalker)
+	dest, destOK := j.destWalker.(subtreeWalker)
+	if j.Options.TwoWay || !j.differ.exactNames() || j.destCount < 0 || !sourceOK || !destOK {
+		return j.run(ctx)
+	}
+
+	paths = outermostPaths(paths)
+	if len(paths) == 1 && paths[0] == "." {
+		return j.run(ctx)
+	}
+
+	j.status = StatusRunning
+	j.lastRun = time.Now()
+
+	fail := func(err error) (*SyncResult, error) {
+		j.status = StatusError
+		j.lastError = err
+		return nil, err
+	}
+
+	if j.checksums != nil {
+		if err := j.checksums.Load(); err != nil {
+			log.Printf("Job %s: %v", j.Name, err)
+		}
+	}
+
+	var sourceFiles, destFiles []fs.FileInfo
+	for _, path := range paths {
+		err := source.WalkSubtree(path, func(info fs.FileInfo) error {
+			sourceFiles = append(sourceFiles, info)
+			return ctx.Err()
+		})
+		if err != nil {
+			return fail(fmt.Errorf("walk source: %w", err))
+		}
+
+		err = dest.WalkSubtree(path, func(info fs.FileInfo) error {
+			destFiles = append(destFiles, info)
+			return ctx.Err()
+		})
+		if err != nil {
+			return fail(fmt.Errorf("walk destination: %w", err))
+		}
+	}
+
+	// The rest of a hard-link group may lie outside the subtrees
+	for _, f := range sourceFiles {
+		if f.HardLinked() {
+			return j.run(ctx)
+		}
+	}
+
+	differ := *j.differ
+	differ.Inodes = nil
+	diffResult := differ.Diff(sourceFiles, destFiles)
+
+	if err := j.checkDeleteLimit(diffResult, 0, j.destCount); err != nil {
+		return fail(err)
+	}
+
+	result, err := j.syncer.Sync(ctx, diffResult, j.SourcePath, j.DestinationPath)
+
+	// Entries outside the subtrees were not walked, so nothing is pruned
+	if j.checksums != nil {
+		if err := j.checksums.Save(); err != nil {
+			log.Printf("Job %s: %v", j.Name, err)
+		}
+	}
+	j.pruneVersions()
+
+	return j.finish(result, err)
+}
+
+// outermostPaths sorts paths and drops those inside another one.
+func outermostPaths(paths []string) []string {
+	cleaned := make([]string, len(paths))
+	for i, path := range paths {
+		cleaned[i] = filepath.Clean(path)
+	}
+	sort.Slice(cleaned, func(a, b int) bool {
+		return fs.ComparePaths(cleaned[a], cleaned[b]) < 0
+	})
+
+	var outer []string
+	for _, path := range cleaned {
+		if path == "." {
+			return []string{"."}
+		}
+		if n := len(outer); n > 0 && (path == outer[n-1] || isBelow(path, outer[n-1])) {
+			continue
+		}
+		outer = append(outer, path)
+	}
+	return outer
+}
@@ -0,0 +1,81 @@
+package sync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOutermostPaths(t *testing.T) {
+	tests := []struct {
+		paths []string
+		want  []string
+	}{
+		{nil, nil},
+		{[]string{"b", "a"}, []string{"a", "b"}},
+		{[]string{"a/b", "a", "a/c/d"}, []string{"a"}},
+		{[]string{"a.txt", "a/b", "a"}, []string{"a", "a.txt"}},
+		{[]string{"ab", "a/b"}, []string{"a/b", "ab"}},
+		{[]string{"a", "a/"}, []string{"a"}},
+		{[]string{"a", "."}, []string{"."}},
+	}
+
+	for _, tt := range tests {
+		var paths, want []string
+		for _, p := range tt.paths {
+			paths = append(paths, filepath.FromSlash(p))
+		}
+		for _, p := range tt.want {
+			want = append(want, filepath.FromSlash(p))
+		}
+		if got := outermostPaths(paths); !reflect.DeepEqual(got, want) {
+			t.Errorf("outermostPaths(%q) = %q, want %q", tt.paths, got, want)
+		}
+	}
+}
+
+func TestRunSubtrees(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	for _, dir := range []string{"a", "b"} {
+		if err := os.Mkdir(filepath.Join(src, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(root, path string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(root, filepath.FromSlash(path)), []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(src, "a/one.txt")
+	write(src, "b/two.txt")
+
+	job := NewJob("test", src, dst, Options{DeleteExtraFiles: true})
+	if _, err := job.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only a is looked at, so b's changes wait for the next full run
+	write(src, "a/new.txt")
+	write(src, "b/new.txt")
+	if err := os.Remove(filepath.Join(src, "a", "one.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := job.RunSubtrees(context.Background(), []string{filepath.Join("a", "new.txt"), "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FilesCreated != 1 || result.FilesDeleted != 1 {
+		t.Errorf("created %d and deleted %d, want 1 and 1", result.FilesCreated, result.FilesDeleted)
+	}
+
+	for path, want := range map[string]bool{"a/new.txt": true, "a/one.txt": false, "b/new.txt": false, "b/two.txt": true} {
+		_, err := os.Stat(filepath.Join(dst, filepath.FromSlash(path)))
+		if got := err == nil; got != want {
+			t.Errorf("%s exists = %v, want %v", path, got, want)
+		}
+	}
+}
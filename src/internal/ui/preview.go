@@ -0,0 +1,184 @@
+package ui
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"excellgene.com/mirrorBox/internal/app"
+	"excellgene.com/mirrorBox/internal/config"
+	syncpkg "excellgene.com/mirrorBox/internal/sync"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+)
+
+// previewFilters lists the action filters offered in the preview window.
+var previewFilters = []string{"All", "Creates", "Updates", "Moves", "Deletes", "Conflicts"}
+
+// previewFilterMatches reports whether an action is shown under a filter.
+func previewFilterMatches(filter string, action syncpkg.Action) bool {
+	switch filter {
+	case "Creates":
+		return action == syncpkg.ActionCreate || action == syncpkg.ActionCreateSource
+	case "Updates":
+		return action == syncpkg.ActionUpdate || action == syncpkg.ActionUpdateSource
+	case "Moves":
+		return action == syncpkg.ActionMove
+	case "Deletes":
+		return action == syncpkg.ActionDelete || action == syncpkg.ActionDeleteSource
+	case "Conflicts":
+		return action == syncpkg.ActionConflict
+	default:
+		return true
+	}
+}
+
+// previewActions is the order actions are summarised in.
+var previewActions = []syncpkg.Action{
+	syncpkg.ActionCreate,
+	syncpkg.ActionUpdate,
+	syncpkg.ActionMove,
+	syncpkg.ActionDelete,
+	syncpkg.ActionCreateSource,
+	syncpkg.ActionUpdateSource,
+	syncpkg.ActionDeleteSource,
+	syncpkg.ActionConflict,
+}
+
+// previewFolder opens a window listing what a sync of the folder pair would
+// do, with an Apply button that carries out exactly that plan.
+func (w *SettingsWindow) previewFolder(folder config.FolderToSync) {
+	modal := w.app.NewWindow("Preview: " + folder.SourcePath + " → " + folder.DestinationPath)
+	modal.SetContent(widget.NewLabel("Comparing folders…"))
+	modal.Resize(fyne.NewSize(700, 600))
+	modal.Show()
+
+	// Use the registered job when there is one, so applying the plan
+	// updates its status like a normal run.
+	job := w.state.GetJob(app.JobName(folder))
+	if job == nil {
+		var err error
+		job, err = w.jobFactory.CreateJob(folder)
+		if err != nil {
+			modal.SetContent(widget.NewLabel(fmt.Sprintf("Cannot preview: %v", err)))
+			return
+		}
+	}
+
+	// Closing the window stops the comparison, which holds the job
+	ctx, cancel := context.WithCancel(context.Background())
+	modal.SetOnClosed(cancel)
+
+	go func() {
+		plan, err := job.Plan(ctx)
+		fyne.Do(func() {
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("Preview of %s failed: %v", job.Name, err)
+				modal.SetContent(widget.NewLabel(fmt.Sprintf("Cannot preview: %v", err)))
+				return
+			}
+			modal.SetContent(w.previewContent(modal, job, plan))
+		})
+	}()
+}
+
+// previewContent builds the plan summary, the filterable list of planned
+// changes and the Apply button.
+func (w *SettingsWindow) previewContent(modal fyne.Window, job *syncpkg.Job, plan *syncpkg.Plan) fyne.CanvasObject {
+	var summary []string
+	for _, action := range previewActions {
+		if total, ok := plan.Totals[action]; ok {
+			summary = append(summary, fmt.Sprintf("%s: %d (%s)", action, total.Count, formatBytes(total.Bytes)))
+		}
+	}
+	if len(summary) == 0 {
+		summary = append(summary, "Nothing to do, both sides are in sync.")
+	}
+	summaryLabel := widget.NewLabel(strings.Join(summary, "\n"))
+
+	var shown []syncpkg.FileDiff
+	list := widget.NewList(
+		func() int { return len(shown) },
+		func() fyne.CanvasObject { return widget.NewLabel("") },
+		func(id widget.ListItemID, item fyne.CanvasObject) {
+			d := shown[id]
+			text := fmt.Sprintf("%-16s %s", d.Action, d.Path)
+			if d.Action == syncpkg.ActionMove {
+				text += " (from " + d.Dest.Path + ")"
+			}
+			if size := d.Size(); size > 0 {
+				text += " (" + formatBytes(size) + ")"
+			}
+			item.(*widget.Label).SetText(text)
+		},
+	)
+
+	filterSelect := widget.NewSelect(previewFilters, nil)
+	searchEntry := widget.NewEntry()
+	searchEntry.SetPlaceHolder("Filter by path")
+
+	applyFilter := func() {
+		shown = shown[:0]
+		query := strings.ToLower(searchEntry.Text)
+		for _, d := range plan.Diff.Diffs {
+			if !previewFilterMatches(filterSelect.Selected, d.Action) {
+				continue
+			}
+			if query != "" && !strings.Contains(strings.ToLower(d.Path), query) {
+				continue
+			}
+			shown = append(shown, d)
+		}
+		list.Refresh()
+	}
+	filterSelect.OnChanged = func(string) { applyFilter() }
+	searchEntry.OnChanged = func(string) { applyFilter() }
+	filterSelect.SetSelected(previewFilters[0])
+
+	applyButton := widget.NewButton("Apply", func() {
+		log.Printf("Applying previewed plan for %s", job.Name)
+		w.dispatcher.ApplyPlan(job, plan)
+		modal.Close()
+	})
+	if plan.Blocked != nil {
+		summaryLabel.SetText(summaryLabel.Text + "\n\n⚠ " + plan.Blocked.Error())
+		applyButton.Disable()
+	}
+	if len(plan.Diff.Diffs) == 0 {
+		applyButton.Disable()
+	}
+
+	cancelButton := widget.NewButton("Close", func() {
+		modal.Close()
+	})
+
+	header := container.NewVBox(
+		widget.NewLabelWithStyle("Planned Changes", fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
+		summaryLabel,
+		widget.NewSeparator(),
+		container.NewGridWithColumns(2, filterSelect, searchEntry),
+	)
+	footer := container.NewGridWithColumns(2, cancelButton, applyButton)
+
+	return container.NewBorder(header, footer, nil, nil, list)
+}
+
+// formatBytes renders a byte count with a binary unit.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -5,11 +5,13 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"excellgene.com/mirrorBox/internal/app"
 	"excellgene.com/mirrorBox/internal/config"
 	syncpkg "excellgene.com/mirrorBox/internal/sync"
+	"excellgene.com/mirrorBox/internal/sync/fs"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/container"
@@ -28,6 +30,7 @@ type SettingsWindow struct {
 	state        *app.State
 	statusWindow *StatusWindow
 	jobFactory   *app.JobFactory
+	dispatcher   *app.Dispatcher
 }
 
 // NewSettingsWindow creates a new settings window.
@@ -38,6 +41,7 @@ func NewSettingsWindow(
 	state *app.State,
 	statusWindow *StatusWindow,
 	jobFactory *app.JobFactory,
+	dispatcher *app.Dispatcher,
 ) *SettingsWindow {
 	return &SettingsWindow{
 		app:          app,
@@ -46,6 +50,7 @@ func NewSettingsWindow(
 		state:        state,
 		statusWindow: statusWindow,
 		jobFactory:   jobFactory,
+		dispatcher:   dispatcher,
 	}
 }
 
@@ -60,6 +65,7 @@ func (w *SettingsWindow) reloadJobs() error {
 
 	// Reload jobs in the state
 	w.state.ReloadJobs(newJobs)
+	w.dispatcher.UpdateWatches()
 
 	log.Printf("Reloaded %d jobs from config", len(newJobs))
 	for _, job := range newJobs {
@@ -131,6 +137,73 @@ func deleteFolder(cfg *config.Config, store *config.Store, index int, refreshFun
 	}
 }
 
+// selectOption pairs a config value with its label in the folder form.
+type selectOption struct {
+	value, label string
+}
+
+// selectOptions lists the choices of a select in display order. The first
+// one stands in for unknown values.
+type selectOptions []selectOption
+
+func (o selectOptions) labels() []string {
+	labels := make([]string, len(o))
+	for i, opt := range o {
+		labels[i] = opt.label
+	}
+	return labels
+}
+
+func (o selectOptions) label(value string) string {
+	for _, opt := range o {
+		if opt.value == value {
+			return opt.label
+		}
+	}
+	return o[0].label
+}
+
+func (o selectOptions) value(label string) string {
+	for _, opt := range o {
+		if opt.label == label {
+			return opt.value
+		}
+	}
+	return o[0].value
+}
+
+var compareModeOptions = selectOptions{
+	{"size-mtime", "Size and modification time"},
+	{"hash", "Size, time and content hash"},
+	{"always-hash", "Content hash on every run"},
+}
+
+var conflictPolicyOptions = selectOptions{
+	{"source-wins", "Source wins"},
+	{"newest-wins", "Newest wins"},
+	{"keep-both", "Keep both copies"},
+	{"skip", "Skip and report"},
+}
+
+var symlinkModeOptions = selectOptions{
+	{"preserve", "Recreate as links"},
+	{"follow", "Follow and copy the target"},
+	{"skip", "Skip"},
+}
+
+var normalizationOptions = selectOptions{
+	{"none", "Keep names as they are"},
+	{"nfc", "Composed (NFC, Linux and Windows)"},
+	{"nfd", "Decomposed (NFD, macOS and some NAS)"},
+}
+
+var versioningOptions = selectOptions{
+	{"", "Off"},
+	{"count", "Keep the newest N versions"},
+	{"days", "Keep versions for N days"},
+	{"staggered", "Staggered (thin out with age, up to N days)"},
+}
+
 func addOrEditFolder(cfg *config.Config, store *config.Store, folderIndex int, refreshFunc func(), reloadJobsFunc func() error) {
 	isEdit := folderIndex >= 0 && folderIndex < len(cfg.Folders)
 
@@ -180,6 +253,139 @@ func addOrEditFolder(cfg *config.Config, store *config.Store, folderIndex int, r
 	enabledCheck := widget.NewCheck("Enabled", func(checked bool) {})
 	enabledCheck.SetChecked(folder.Enabled)
 
+	// Mirror mode and its deletion safety limit
+	deleteLimitEntry := widget.NewEntry()
+	deleteLimitEntry.SetPlaceHolder("0 = no limit")
+	deleteLimitEntry.SetText(strconv.Itoa(folder.DeleteLimit))
+
+	deleteLimitUnit := widget.NewSelect([]string{"files", "% of destination"}, nil)
+	if folder.DeleteLimitPercent {
+		deleteLimitUnit.SetSelected("% of destination")
+	} else {
+		deleteLimitUnit.SetSelected("files")
+	}
+
+	var mirrorCheck, twoWayCheck *widget.Check
+
+	// The deletion limit applies whenever a run may delete files.
+	updateDeleteLimit := func() {
+		if mirrorCheck.Checked || twoWayCheck.Checked {
+			deleteLimitEntry.Enable()
+			deleteLimitUnit.Enable()
+		} else {
+			deleteLimitEntry.Disable()
+			deleteLimitUnit.Disable()
+		}
+	}
+
+	mirrorCheck = widget.NewCheck("Mirror (delete files removed from the source)", func(checked bool) {
+		updateDeleteLimit()
+	})
+	twoWayCheck = widget.NewCheck("Two-way (apply changes made on either side)", func(checked bool) {
+		if checked {
+			mirrorCheck.Disable()
+		} else {
+			mirrorCheck.Enable()
+		}
+		updateDeleteLimit()
+	})
+	mirrorCheck.SetChecked(folder.Mirror)
+	twoWayCheck.SetChecked(folder.TwoWay)
+	updateDeleteLimit()
+
+	compareSelect := widget.NewSelect(compareModeOptions.labels(), nil)
+	compareSelect.SetSelected(compareModeOptions.label(folder.CompareMode))
+
+	conflictSelect := widget.NewSelect(conflictPolicyOptions.labels(), nil)
+	conflictSelect.SetSelected(conflictPolicyOptions.label(folder.ConflictPolicy))
+
+	rewriteLinksCheck := widget.NewCheck("Rewrite absolute links that point inside the source", nil)
+	rewriteLinksCheck.SetChecked(folder.RewriteSymlinks)
+
+	symlinkSelect := widget.NewSelect(symlinkModeOptions.labels(), func(label string) {
+		if symlinkModeOptions.value(label) == "preserve" {
+			rewriteLinksCheck.Enable()
+		} else {
+			rewriteLinksCheck.Disable()
+		}
+	})
+	symlinkSelect.SetSelected(symlinkModeOptions.label(folder.SymlinkMode))
+
+	normalizationSelect := widget.NewSelect(normalizationOptions.labels(), nil)
+	normalizationSelect.SetSelected(normalizationOptions.label(folder.UnicodeNormalization))
+
+	caseInsensitiveCheck := widget.NewCheck("Destination ignores letter case", nil)
+	caseInsensitiveCheck.SetChecked(folder.CaseInsensitive)
+
+	sanitizeCheck := widget.NewCheck("Encode names exFAT, FAT32 and Windows cannot store", nil)
+	sanitizeCheck.SetChecked(folder.SanitizeNames)
+
+	deltaCheck := widget.NewCheck("Delta transfer (rewrite only changed blocks of large files)", nil)
+	deltaCheck.SetChecked(folder.DeltaTransfer)
+
+	verifyCheck := widget.NewCheck("Verify copies by reading them back", nil)
+	verifyCheck.SetChecked(folder.Verify)
+
+	fsyncCheck := widget.NewCheck("Flush each file to disk (slower, survives power loss)", nil)
+	fsyncCheck.SetChecked(folder.Fsync)
+
+	streamingCheck := widget.NewCheck("Stream very large trees (no move or hard-link detection)", nil)
+	streamingCheck.SetChecked(folder.Streaming)
+
+	fullRescanEntry := widget.NewEntry()
+	fullRescanEntry.SetPlaceHolder("0 = daily")
+	fullRescanEntry.SetText(strconv.Itoa(folder.FullRescanHours))
+
+	continuousCheck := widget.NewCheck("Sync changes as they happen (watch the source)", nil)
+	continuousCheck.SetChecked(folder.Continuous)
+
+	incrementalCheck := widget.NewCheck("Only rescan changed directories", func(checked bool) {
+		if checked {
+			fullRescanEntry.Enable()
+		} else {
+			fullRescanEntry.Disable()
+		}
+	})
+	incrementalCheck.SetChecked(folder.IncrementalScan)
+	if !folder.IncrementalScan {
+		fullRescanEntry.Disable()
+	}
+
+	xattrsCheck := widget.NewCheck("Extended attributes", nil)
+	xattrsCheck.SetChecked(folder.PreserveXattrs)
+	aclsCheck := widget.NewCheck("ACLs", nil)
+	aclsCheck.SetChecked(folder.PreserveACLs)
+	ownershipCheck := widget.NewCheck("Owner and group (as root)", nil)
+	ownershipCheck.SetChecked(folder.PreserveOwnership)
+	dirTimesCheck := widget.NewCheck("Directory times", nil)
+	dirTimesCheck.SetChecked(folder.PreserveDirTimes)
+
+	concurrencyEntry := widget.NewEntry()
+	concurrencyEntry.SetPlaceHolder(fmt.Sprintf("0 = default (%d)", syncpkg.DefaultConcurrency))
+	concurrencyEntry.SetText(strconv.Itoa(folder.Concurrency))
+
+	rateLimitEntry := widget.NewEntry()
+	rateLimitEntry.SetPlaceHolder("0 = use the global limit")
+	rateLimitEntry.SetText(strconv.FormatInt(folder.RateLimit/1024, 10))
+
+	versionsKeepEntry := widget.NewEntry()
+	versionsKeepEntry.SetPlaceHolder("0 = forever")
+	versionsKeepEntry.SetText(strconv.Itoa(folder.VersionsKeep))
+
+	versioningSelect := widget.NewSelect(versioningOptions.labels(), func(label string) {
+		if versioningOptions.value(label) == "" {
+			versionsKeepEntry.Disable()
+		} else {
+			versionsKeepEntry.Enable()
+		}
+	})
+	versioningSelect.SetSelected(versioningOptions.label(folder.Versioning))
+
+	ignoreEntry := widget.NewMultiLineEntry()
+	ignoreEntry.SetPlaceHolder("node_modules/\n.git/\n*.swp")
+	ignoreEntry.SetText(strings.Join(folder.IgnoreRules, "\n"))
+	ignoreEntry.SetMinRowsVisible(4)
+
 	saveButton := widget.NewButton("Save", func() {
 		// Validate paths
 		if sourceEntry.Text == "" || destinationEntry.Text == "" {
@@ -190,9 +396,100 @@ func addOrEditFolder(cfg *config.Config, store *config.Store, folderIndex int, r
 			return
 		}
 
+		deleteLimit, err := strconv.Atoi(deleteLimitEntry.Text)
+		if err != nil || deleteLimit < 0 {
+			dialog.ShowError(
+				fmt.Errorf("please enter a valid deletion limit (0 or greater)"),
+				modal,
+			)
+			return
+		}
+		deleteLimitPercent := deleteLimitUnit.Selected == "% of destination"
+		if deleteLimitPercent && deleteLimit > 100 {
+			dialog.ShowError(
+				fmt.Errorf("a percentage deletion limit must be between 0 and 100"),
+				modal,
+			)
+			return
+		}
+
+		concurrency, err := strconv.Atoi(concurrencyEntry.Text)
+		if err != nil || concurrency < 0 || concurrency > app.MaxConcurrency {
+			dialog.ShowError(
+				fmt.Errorf("parallel transfers must be between 0 and %d", app.MaxConcurrency),
+				modal,
+			)
+			return
+		}
+
+		rateLimit, err := strconv.ParseInt(rateLimitEntry.Text, 10, 64)
+		if err != nil || rateLimit < 0 {
+			dialog.ShowError(
+				fmt.Errorf("please enter a valid bandwidth limit (0 or greater)"),
+				modal,
+			)
+			return
+		}
+
+		versionsKeep, err := strconv.Atoi(versionsKeepEntry.Text)
+		if err != nil || versionsKeep < 0 {
+			dialog.ShowError(
+				fmt.Errorf("please enter a valid version retention (0 or greater)"),
+				modal,
+			)
+			return
+		}
+
+		fullRescanHours, err := strconv.Atoi(fullRescanEntry.Text)
+		if err != nil || fullRescanHours < 0 {
+			dialog.ShowError(
+				fmt.Errorf("please enter a valid full rescan interval (0 or greater)"),
+				modal,
+			)
+			return
+		}
+
+		var ignoreRules []string
+		for _, line := range strings.Split(ignoreEntry.Text, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				ignoreRules = append(ignoreRules, line)
+			}
+		}
+		if _, err := fs.ParseIgnoreRules(ignoreRules); err != nil {
+			dialog.ShowError(err, modal)
+			return
+		}
+
 		folder.SourcePath = sourceEntry.Text
 		folder.DestinationPath = destinationEntry.Text
 		folder.Enabled = enabledCheck.Checked
+		folder.Mirror = mirrorCheck.Checked
+		folder.TwoWay = twoWayCheck.Checked
+		folder.DeleteLimit = deleteLimit
+		folder.DeleteLimitPercent = deleteLimitPercent
+		folder.CompareMode = compareModeOptions.value(compareSelect.Selected)
+		folder.ConflictPolicy = conflictPolicyOptions.value(conflictSelect.Selected)
+		folder.IgnoreRules = ignoreRules
+		folder.SymlinkMode = symlinkModeOptions.value(symlinkSelect.Selected)
+		folder.RewriteSymlinks = rewriteLinksCheck.Checked
+		folder.UnicodeNormalization = normalizationOptions.value(normalizationSelect.Selected)
+		folder.CaseInsensitive = caseInsensitiveCheck.Checked
+		folder.SanitizeNames = sanitizeCheck.Checked
+		folder.DeltaTransfer = deltaCheck.Checked
+		folder.Concurrency = concurrency
+		folder.Verify = verifyCheck.Checked
+		folder.Fsync = fsyncCheck.Checked
+		folder.Streaming = streamingCheck.Checked
+		folder.IncrementalScan = incrementalCheck.Checked
+		folder.Continuous = continuousCheck.Checked
+		folder.FullRescanHours = fullRescanHours
+		folder.PreserveXattrs = xattrsCheck.Checked
+		folder.PreserveACLs = aclsCheck.Checked
+		folder.PreserveOwnership = ownershipCheck.Checked
+		folder.PreserveDirTimes = dirTimesCheck.Checked
+		folder.Versioning = versioningOptions.value(versioningSelect.Selected)
+		folder.VersionsKeep = versionsKeep
+		folder.RateLimit = rateLimit * 1024
 
 		if isEdit {
 			cfg.Folders[folderIndex] = folder
@@ -242,16 +539,58 @@ func addOrEditFolder(cfg *config.Config, store *config.Store, folderIndex int, r
 
 		enabledCheck,
 		widget.NewSeparator(),
+
+		twoWayCheck,
+		mirrorCheck,
+		widget.NewLabel("Abort a run that would delete more than:"),
+		container.NewGridWithColumns(2, deleteLimitEntry, deleteLimitUnit),
+		widget.NewSeparator(),
+
+		widget.NewLabel("Detect changed files by"),
+		compareSelect,
+		widget.NewLabel("When a file changed on both sides"),
+		conflictSelect,
+		widget.NewLabel("Symbolic links"),
+		symlinkSelect,
+		rewriteLinksCheck,
+		widget.NewLabel("Unicode form of destination names"),
+		normalizationSelect,
+		caseInsensitiveCheck,
+		sanitizeCheck,
+		deltaCheck,
+		verifyCheck,
+		fsyncCheck,
+		streamingCheck,
+		continuousCheck,
+		incrementalCheck,
+		widget.NewLabel("Full rescan every (hours)"),
+		fullRescanEntry,
+		widget.NewLabel("Also preserve"),
+		container.NewGridWithColumns(2, xattrsCheck, aclsCheck, ownershipCheck, dirTimesCheck),
+		widget.NewLabel("Parallel transfers"),
+		concurrencyEntry,
+		widget.NewLabel("Bandwidth limit for this folder (KiB/s)"),
+		rateLimitEntry,
+		widget.NewSeparator(),
+
+		widget.NewLabel("Keep replaced and deleted files"),
+		container.NewGridWithColumns(2, versioningSelect, versionsKeepEntry),
+		widget.NewSeparator(),
+
+		widget.NewLabel("Ignore rules (gitignore syntax, one per line)"),
+		ignoreEntry,
+		widget.NewSeparator(),
 		container.NewGridWithColumns(2, cancelButton, saveButton),
 	)
 
-	modal.SetContent(form)
-	modal.Resize(fyne.NewSize(700, 400))
+	// The form outgrows small screens, so let it scroll.
+	modal.SetContent(container.NewVScroll(form))
+	modal.Resize(fyne.NewSize(700, 800))
 	modal.Show()
 }
 
 // NewFolderWindow creates a new folder window.
-func NewFolderWindow(app fyne.App, cfg *config.Config, store *config.Store, reloadJobsFunc func() error) fyne.Window {
+func NewFolderWindow(app fyne.App, cfg *config.Config, store *config.Store, reloadJobsFunc func() error, previewFunc func(config.FolderToSync)) fyne.Window {
 	modal := fyne.CurrentApp().NewWindow("Syncing Folders")
 
 	// Container for the folder list
@@ -287,6 +626,11 @@ func NewFolderWindow(app fyne.App, cfg *config.Config, store *config.Store, relo
 				if !folder.Enabled {
 					statusText = "✗ Disabled"
 				}
+				if folder.TwoWay {
+					statusText += " · Two-way"
+				} else if folder.Mirror {
+					statusText += " · Mirror"
+				}
 
 				// Folder card
 				folderLabel := widget.NewLabel(folder.SourcePath + " → " + folder.DestinationPath)
@@ -312,7 +656,13 @@ func NewFolderWindow(app fyne.App, cfg *config.Config, store *config.Store, relo
 					confirmDialog.Show()
 				})
 
-				buttonRow := container.NewGridWithColumns(2, editBtn, deleteBtn)
+				previewBtn := widget.NewButton("Preview", func() {
+					if previewFunc != nil {
+						previewFunc(folder)
+					}
+				})
+
+				buttonRow := container.NewGridWithColumns(3, previewBtn, editBtn, deleteBtn)
 
 				folderCard := container.NewVBox(
 					folderLabel,
@@ -368,6 +718,15 @@ func (w *SettingsWindow) changeGeneralSettings() {
 	startAtBootCheck := widget.NewCheck("Start MirrorBox at login", nil)
 	startAtBootCheck.SetChecked(w.config.StartAtBoot)
 
+	rateLimitEntry := widget.NewEntry()
+	rateLimitEntry.SetPlaceHolder("0 = unlimited")
+	rateLimitEntry.SetText(strconv.FormatInt(w.config.RateLimit/1024, 10))
+
+	rateScheduleEntry := widget.NewMultiLineEntry()
+	rateScheduleEntry.SetPlaceHolder("09:00-18:00 512\n22:00-07:00 0")
+	rateScheduleEntry.SetText(formatRateSchedule(w.config.RateSchedule))
+	rateScheduleEntry.SetMinRowsVisible(3)
+
 	saveButton := widget.NewButton("Save", func() {
 		minutes, err := strconv.Atoi(minutesEntry.Text)
 		if err != nil || minutes <= 0 {
@@ -378,8 +737,25 @@ func (w *SettingsWindow) changeGeneralSettings() {
 			return
 		}
 
+		rateLimit, err := strconv.ParseInt(rateLimitEntry.Text, 10, 64)
+		if err != nil || rateLimit < 0 {
+			dialog.ShowError(
+				fmt.Errorf("please enter a valid bandwidth limit (0 or greater)"),
+				modal,
+			)
+			return
+		}
+
+		rateSchedule, err := parseRateSchedule(rateScheduleEntry.Text)
+		if err != nil {
+			dialog.ShowError(err, modal)
+			return
+		}
+
 		w.config.CheckInterval = time.Duration(minutes) * time.Minute
 		w.config.StartAtBoot = startAtBootCheck.Checked
+		w.config.RateLimit = rateLimit * 1024
+		w.config.RateSchedule = rateSchedule
 
 		if err := w.saveConfigAndReload(); err != nil {
 			log.Printf("Failed to save config and reload jobs: %v", err)
@@ -419,14 +795,58 @@ func (w *SettingsWindow) changeGeneralSettings() {
 		startAtBootCheck,
 		widget.NewLabel("Enable to launch MirrorBox automatically after you log in."),
 		widget.NewSeparator(),
+		widget.NewLabelWithStyle("Bandwidth", fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
+		widget.NewLabel("Limit for all folders together (KiB/s):"),
+		rateLimitEntry,
+		widget.NewLabel("Different limits by time of day (HH:MM-HH:MM KiB/s, one per line):"),
+		rateScheduleEntry,
+		widget.NewSeparator(),
 		container.NewGridWithColumns(2, cancelButton, saveButton),
 	)
 
 	modal.SetContent(form)
-	modal.Resize(fyne.NewSize(500, 300))
+	modal.Resize(fyne.NewSize(500, 520))
 	modal.Show()
 }
 
+// parseRateSchedule reads "HH:MM-HH:MM KiB/s" lines into rate windows.
+func parseRateSchedule(text string) ([]config.RateWindow, error) {
+	var windows []config.RateWindow
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		times := strings.Split(fields[0], "-")
+		if len(fields) != 2 || len(times) != 2 {
+			return nil, fmt.Errorf("invalid schedule line %q, expected HH:MM-HH:MM KiB/s", line)
+		}
+		for _, t := range times {
+			if _, err := fs.ParseTimeOfDay(t); err != nil {
+				return nil, err
+			}
+		}
+		limit, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid limit in schedule line %q", line)
+		}
+
+		windows = append(windows, config.RateWindow{Start: times[0], End: times[1], Limit: limit * 1024})
+	}
+	return windows, nil
+}
+
+// formatRateSchedule is the inverse of parseRateSchedule.
+func formatRateSchedule(windows []config.RateWindow) string {
+	lines := make([]string, len(windows))
+	for i, w := range windows {
+		lines[i] = fmt.Sprintf("%s-%s %d", w.Start, w.End, w.Limit/1024)
+	}
+	return strings.Join(lines, "\n")
+}
+
 // getLastJobStatus returns a formatted string with the last job execution status.
 func (w *SettingsWindow) getLastJobStatus() string {
 	jobs := w.state.AllJobs()
@@ -454,8 +874,8 @@ func (w *SettingsWindow) getLastJobStatus() string {
 	statusText += fmt.Sprintf("Run Time: %v\n", lastTime.Format("2006-01-02 15:04:05"))
 
 	if result := lastJob.LastResult(); result != nil {
-		statusText += fmt.Sprintf("Created: %d, Updated: %d, Deleted: %d",
-			result.FilesCreated, result.FilesUpdated, result.FilesDeleted)
+		statusText += fmt.Sprintf("Created: %d, Updated: %d, Deleted: %d, Conflicts: %d",
+			result.FilesCreated, result.FilesUpdated, result.FilesDeleted, result.Conflicts)
 	}
 
 	if err := lastJob.LastError(); err != nil {
@@ -506,7 +926,7 @@ func (w *SettingsWindow) Show() {
 			widget.NewButton(
 				"Manage Sync Folders",
 				func() {
-					folderWindow := NewFolderWindow(w.app, w.config, w.store, w.reloadJobs)
+					folderWindow := NewFolderWindow(w.app, w.config, w.store, w.reloadJobs, w.previewFolder)
 					folderWindow.Show()
 				},
 			),
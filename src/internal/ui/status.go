@@ -111,8 +111,19 @@ func (w *StatusWindow) renderJob(job *syncpkg.Job) fyne.CanvasObject {
 			fmt.Sprintf("  Created: %d", result.FilesCreated),
 			fmt.Sprintf("  Updated: %d", result.FilesUpdated),
 			fmt.Sprintf("  Deleted: %d", result.FilesDeleted),
+			fmt.Sprintf("  Moved: %d", result.FilesMoved),
+			fmt.Sprintf("  Conflicts: %d", result.Conflicts),
 			fmt.Sprintf("  Bytes Copied: %d", result.BytesCopied),
+			fmt.Sprintf("  Bytes Written: %d", result.BytesWritten),
+			fmt.Sprintf("  Bytes Allocated: %d", result.BytesAllocated),
+			fmt.Sprintf("  Hard Links: %d", result.HardLinks),
 		)
+		if methods := result.CopyMethodSummary(); methods != "" {
+			lines = append(lines, "  Copied By: "+methods)
+		}
+		for _, warning := range result.Warnings {
+			lines = append(lines, "  Warning: "+warning)
+		}
 	}
 
 	if err := job.LastError(); err != nil {